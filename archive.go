@@ -0,0 +1,244 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// manifestName is the archive entry holding the manifest.
+	manifestName = "manifest.json"
+	// archiveKeysDir is the archive directory holding one entry per key.
+	archiveKeysDir = "keys/"
+)
+
+// manifest describes the contents of an archive.
+type manifest struct {
+	Source     string                 `json:"source"`
+	Datacenter string                 `json:"datacenter,omitempty"`
+	Index      uint64                 `json:"index,omitempty"`
+	Exported   time.Time              `json:"exported"`
+	Count      int                    `json:"count"`
+	Keys       map[string]manifestKey `json:"keys"`
+}
+
+// manifestKey describes a single key in an archive.
+type manifestKey struct {
+	SHA256 string `json:"sha256"`
+	Flags  uint64 `json:"flags,omitempty"`
+}
+
+// sourceDatacenter returns the datacenter the values were read from, asking
+// the agent when the profile does not name one.
+func sourceDatacenter() string {
+	if source.Datacenter != "" || srcClient == nil || !consulSource {
+		return source.Datacenter
+	}
+
+	self, err := srcClient.Agent().Self()
+	if err != nil {
+		return ""
+	}
+	dc, _ := self["Config"]["Datacenter"].(string)
+	return dc
+}
+
+// checksum returns the hex encoded SHA-256 of a value.
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// writeArchive writes a tree to a gzipped tar archive holding one entry per
+// key, preceded by a manifest, or to stdout for "-". The function exits if
+// the archive cannot be written.
+func writeArchive(t tree, filename string) {
+	leaves := t.flatten()
+	folders := folderKeys(leaves)
+
+	keys := []string{}
+	for key := range leaves {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	m := manifest{
+		Source:     source.Address,
+		Datacenter: sourceDatacenter(),
+		Index:      source.Index,
+		Exported:   time.Now().UTC(),
+		Count:      len(keys),
+		Keys:       map[string]manifestKey{},
+	}
+	if !consulSource {
+		m.Source = srcJSON.String() + srcDir + srcArchive
+	}
+
+	data := map[string][]byte{}
+	for _, key := range keys {
+		v, flags := leaves[key], uint64(0)
+		if e, ok := v.(entry); ok {
+			v, flags = e.Value, e.Flags
+		}
+		if strings.HasSuffix(key, "/") {
+			dropFolderValue(key, v)
+			v = ""
+		}
+		data[key] = resolveBytes(v)
+		m.Keys[key] = manifestKey{SHA256: checksum(data[key]), Flags: flags}
+	}
+
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	archive := tar.NewWriter(gz)
+
+	// folder keys, ending in "/", are written as directories
+	writeEntry := func(name string, contents []byte) {
+		header := &tar.Header{
+			Name:    name,
+			Mode:    0644,
+			Size:    int64(len(contents)),
+			ModTime: m.Exported.Truncate(time.Second),
+		}
+		if strings.HasSuffix(name, "/") {
+			header.Typeflag, header.Mode = tar.TypeDir, 0755
+		}
+		if err := archive.WriteHeader(header); err != nil {
+			fatalf("Failed to write archive, %s => {%s}", filename, err)
+		}
+		if _, err := archive.Write(contents); err != nil {
+			fatalf("Failed to write archive, %s => {%s}", filename, err)
+		}
+	}
+
+	encoded, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		fatalf("Error marshaling data for JSON => {%s}", err)
+	}
+	writeEntry(manifestName, encoded)
+	for _, key := range keys {
+		writeEntry(archiveKeysDir+keyFileName(key, folders[key]), data[key])
+	}
+
+	if err := archive.Close(); err != nil {
+		fatalf("Failed to write archive, %s => {%s}", filename, err)
+	}
+	if err := gz.Close(); err != nil {
+		fatalf("Failed to write archive, %s => {%s}", filename, err)
+	}
+	if err := writeFileAtomic(filename, buf.Bytes(), outputMode()); err != nil {
+		fatalf("Failed to write archive, %s => {%s}", filename, err)
+	}
+}
+
+// readArchive constructs a tree from an archive written by writeArchive, or
+// from stdin for "-". The whole archive is checked against its manifest before
+// the tree is returned, so nothing is written from an archive that is
+// incomplete or altered. The function exits if it is.
+func readArchive(filename string) tree {
+	file, err := openInput(filename)
+	if err != nil {
+		fatalf("Failed to open archive, %s => {%s}", filename, err)
+	}
+	defer file.Close()
+
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		fatalf("Failed to read archive, %s => {%s}", filename, err)
+	}
+	archive := tar.NewReader(gz)
+
+	var m *manifest
+	data := map[string][]byte{}
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			fatalf("Failed to read archive, %s => {%s}", filename, err)
+		}
+		isFolderKey := strings.HasPrefix(header.Name, archiveKeysDir) && header.Name != archiveKeysDir
+		if header.Typeflag == tar.TypeDir && !isFolderKey {
+			continue
+		}
+
+		contents, err := ioutil.ReadAll(archive)
+		if err != nil {
+			fatalf("Failed to read archive, %s => {%s}", filename, err)
+		}
+
+		switch {
+		case header.Name == manifestName:
+			m = &manifest{}
+			if err := json.Unmarshal(contents, m); err != nil {
+				fatalf("Failed to decode archive manifest, %s => {%s}", filename, err)
+			}
+		case strings.HasPrefix(header.Name, archiveKeysDir):
+			key, err := fileNameKey(strings.TrimPrefix(header.Name, archiveKeysDir))
+			if err != nil {
+				fatalf("Invalid entry in archive, %s => {%s}", header.Name, err)
+			}
+			data[key] = contents
+		default:
+			fatalf("Unexpected entry in archive, %s", header.Name)
+		}
+	}
+
+	if m == nil {
+		fatalf("Archive has no manifest, %s", filename)
+	}
+	if problems := m.verify(data); len(problems) > 0 {
+		for _, problem := range problems {
+			logf("error", logFields{Operation: "read", ErrorClass: classValidation}, "%s", problem)
+		}
+		fatal(classValidation, logFields{Operation: "read"}, "Archive does not match its manifest, %s", filename)
+	}
+
+	values := tree{}
+	for key, contents := range data {
+		if flags := m.Keys[key].Flags; flags != 0 {
+			values.add(key, entry{Value: bytesValue(contents), Flags: flags})
+		} else {
+			values.add(key, bytesValue(contents))
+		}
+	}
+	values.decrypt(secrets, "")
+
+	return values
+}
+
+// verify compares the entries of an archive with its manifest, returning a
+// description of every difference.
+func (m *manifest) verify(data map[string][]byte) []string {
+	problems := []string{}
+	if m.Count != len(m.Keys) || m.Count != len(data) {
+		problems = append(problems, fmt.Sprintf("manifest lists %d keys, archive holds %d", m.Count, len(data)))
+	}
+
+	for key, described := range m.Keys {
+		contents, ok := data[key]
+		if !ok {
+			problems = append(problems, "missing key "+key)
+		} else if checksum(contents) != described.SHA256 {
+			problems = append(problems, "checksum does not match for key "+key)
+		}
+	}
+	for key := range data {
+		if _, ok := m.Keys[key]; !ok {
+			problems = append(problems, "key not in manifest "+key)
+		}
+	}
+
+	sort.Strings(problems)
+	return problems
+}
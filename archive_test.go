@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestArchiveRoundTrip(t *testing.T) {
+	file, err := ioutil.TempFile("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	tmpFile := file.Name()
+	defer os.Remove(tmpFile)
+
+	values := tree{
+		"app": map[string]interface{}{
+			"schema":     entry{Value: "v2", Flags: 7},
+			"weird key%": "x",
+		},
+	}
+	writeArchive(values, tmpFile)
+	loaded := readArchive(tmpFile).flatten()
+
+	if e, ok := loaded["app/schema"].(entry); !ok || e.Value != "v2" || e.Flags != 7 {
+		t.Errorf("Expected the flags to be kept, recieved: %#v", loaded["app/schema"])
+	}
+	if loaded["app/weird key%"] != "x" {
+		t.Errorf("Expected: x\nRecieved: %v", loaded["app/weird key%"])
+	}
+}
+
+func TestManifestVerify(t *testing.T) {
+	m := manifest{
+		Count: 2,
+		Keys: map[string]manifestKey{
+			"a": {SHA256: checksum([]byte("1"))},
+			"b": {SHA256: checksum([]byte("2"))},
+		},
+	}
+
+	if problems := m.verify(map[string][]byte{"a": []byte("1"), "b": []byte("2")}); len(problems) != 0 {
+		t.Errorf("Expected no problems, recieved: %v", problems)
+	}
+
+	problems := m.verify(map[string][]byte{"a": []byte("x"), "c": []byte("3")})
+	expected := []string{
+		"checksum does not match for key a",
+		"key not in manifest c",
+		"missing key b",
+	}
+	if len(problems) != len(expected) {
+		t.Fatalf("Expected: %v\nRecieved: %v", expected, problems)
+	}
+	for i := range expected {
+		if problems[i] != expected[i] {
+			t.Errorf("Expected: %s\nRecieved: %s", expected[i], problems[i])
+		}
+	}
+}
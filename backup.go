@@ -0,0 +1,351 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// backupTimeFormat is the layout of the timestamp in backup file names.
+const backupTimeFormat = "20060102T150405Z"
+
+// backup is the layout of a backup file. The checksum covers the encoded tree.
+type backup struct {
+	Prefix   string          `json:"prefix"`
+	Created  time.Time       `json:"created"`
+	Keys     int             `json:"keys"`
+	Checksum string          `json:"sha256"`
+	Tree     json.RawMessage `json:"tree"`
+}
+
+// parseCommandFlags parses the flags of a command that takes one positional
+// argument, allowing the flags on either side of it.
+func parseCommandFlags(fs *flag.FlagSet, args []string) string {
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		return ""
+	}
+	arg := fs.Arg(0)
+	fs.Parse(fs.Args()[1:])
+	if fs.NArg() > 0 {
+		usageErrorf("Unexpected arguments, %s", strings.Join(fs.Args(), " "))
+	}
+	return arg
+}
+
+// rootBackupName is the name of the backups of the whole store. Since "@" is
+// escaped in prefixes, it cannot be the name of a prefix.
+const rootBackupName = "@root"
+
+// backupName returns the prefix of the file names used for backups of a
+// prefix. The prefix is escaped as a single file name segment, so distinct
+// prefixes such as "a/b" and "a_b" never share their backups.
+func backupName(prefix string) string {
+	if prefix == "" {
+		return rootBackupName
+	}
+	return escapeSegment(prefix)
+}
+
+// backupPrefix writes a timestamped, checksummed backup of a prefix, or of the
+// whole store, and then applies the retention rules to its older backups.
+func backupPrefix(args []string) {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	dir := fs.String("dir", "backups", "directory to write backups to")
+	keep := fs.Int("keep", 0, "number of most recent backups to keep (0 keeps all unless other rules are set)")
+	keepDaily := fs.Int("keepDaily", 0, "number of days for which the last backup of the day is kept")
+	keepWeekly := fs.Int("keepWeekly", 0, "number of weeks for which the last backup of the week is kept")
+	prefix := parseCommandFlags(fs, args)
+
+	// backups should reflect the leader's view of the store
+	if consistency == "" {
+		consistency = "consistent"
+	}
+	exportMeta = true
+	connect()
+	checkConsistency()
+	checkPrefixMode()
+
+	values := readConsulTree(prefix)
+	data, err := json.Marshal(values)
+	if err != nil {
+		fatalf("Error marshaling data for JSON => {%s}", err)
+	}
+	checksum := sha256.Sum256(data)
+
+	created := time.Now().UTC()
+	b := backup{
+		Prefix:   prefix,
+		Created:  created,
+		Keys:     len(values.flatten()),
+		Checksum: hex.EncodeToString(checksum[:]),
+		Tree:     data,
+	}
+
+	if err := os.MkdirAll(*dir, 0700); err != nil {
+		fatalf("Failed to create backup directory, %s => {%s}", *dir, err)
+	}
+	filename := filepath.Join(*dir, fmt.Sprintf("%s-%s.json", backupName(prefix), created.Format(backupTimeFormat)))
+	data, err = json.Marshal(b)
+	if err != nil {
+		fatalf("Error marshaling data for JSON => {%s}", err)
+	}
+	if err := writeFileAtomic(filename, data, 0600); err != nil {
+		fatalf("Failed to write backup, %s => {%s}", filename, err)
+	}
+	logf("info", logFields{Operation: "backup"}, "Backed up %d keys to %s", b.Keys, filename)
+
+	pruneBackups(*dir, backupName(prefix), *keep, *keepDaily, *keepWeekly)
+}
+
+// pruneBackups removes the backups of a prefix not kept by any retention
+// rule: the most recent backups, the last backup of each recent day and the
+// last backup of each recent week. Nothing is removed without a rule.
+func pruneBackups(dir, name string, keep, keepDaily, keepWeekly int) {
+	if keep == 0 && keepDaily == 0 && keepWeekly == 0 {
+		return
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, name+"-*.json"))
+	if err != nil {
+		fatalf("Failed to list backups => {%s}", err)
+	}
+
+	// the timestamps sort the backups from newest to oldest
+	times := map[string]time.Time{}
+	sorted := []string{}
+	for _, file := range files {
+		stamp := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(file), name+"-"), ".json")
+		t, err := time.Parse(backupTimeFormat, stamp)
+		if err != nil {
+			continue
+		}
+		times[file] = t
+		sorted = append(sorted, file)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(sorted)))
+
+	kept := map[string]bool{}
+	days := map[string]bool{}
+	weeks := map[string]bool{}
+	for i, file := range sorted {
+		t := times[file]
+		day := t.Format("2006-01-02")
+		year, week := t.ISOWeek()
+		weekName := fmt.Sprintf("%d-%d", year, week)
+
+		if i < keep {
+			kept[file] = true
+		}
+		if !days[day] && len(days) < keepDaily {
+			days[day] = true
+			kept[file] = true
+		}
+		if !weeks[weekName] && len(weeks) < keepWeekly {
+			weeks[weekName] = true
+			kept[file] = true
+		}
+	}
+
+	for _, file := range sorted {
+		if kept[file] {
+			continue
+		}
+		if err := os.Remove(file); err != nil {
+			fatalf("Failed to remove old backup, %s => {%s}", file, err)
+		}
+		logf("info", logFields{Operation: "backup"}, "Removed old backup %s", file)
+	}
+}
+
+// readBackup loads a backup file and verifies its checksum. The function
+// exits if the file is damaged.
+func readBackup(filename string) (backup, tree) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		fatalf("Failed to read backup, %s => {%s}", filename, err)
+	}
+
+	b := backup{}
+	if err := json.Unmarshal(data, &b); err != nil {
+		fatalf("Failed to decode backup, %s => {%s}", filename, err)
+	}
+
+	checksum := sha256.Sum256(b.Tree)
+	if hex.EncodeToString(checksum[:]) != b.Checksum {
+		fatalf("Backup checksum does not match, %s", filename)
+	}
+
+	values := tree{}
+	if err := json.Unmarshal(b.Tree, &values); err != nil {
+		fatalf("Failed to decode backup, %s => {%s}", filename, err)
+	}
+	values.decodeEntries()
+
+	return b, values
+}
+
+// restoreBackup replays a backup into Consul, either where it was taken or
+// under another prefix. A dry run only reports the changes it would make, and
+// pruning deletes the keys under the prefix that are not in the backup.
+func restoreBackup(args []string) {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	to := fs.String("to", "", "prefix to restore to instead of the one backed up")
+	dryRun := fs.Bool("dry-run", false, "report the changes without writing them")
+	prune := fs.Bool("prune", false, "delete keys under the prefix that are not in the backup")
+	filename := parseCommandFlags(fs, args)
+	if filename == "" {
+		usageErrorf("Usage: consul_loader restore <backup> [-to prefix] [-dry-run] [-prune]")
+	}
+
+	b, values := readBackup(filename)
+	connect()
+	checkConsistency()
+	checkOnConflict()
+	summary.Read = b.Keys
+
+	// place every key where it belongs in the destination
+	target := tree{}
+	for p, v := range values.flatten() {
+		target.add(restoreKey(b.Prefix, *to, p), v)
+	}
+	prefix := b.Prefix
+	if *to != "" {
+		prefix = *to
+	}
+
+	// large values are compared as the chunks they are stored in
+	leaves := target.flatten()
+	if chunkValues {
+		for _, key := range oversizedKeys(leaves) {
+			splitValue(leaves, key)
+		}
+	}
+	changes := diffConsul(leaves, prefix, *prune)
+	lines := changes.lines()
+	for _, line := range lines {
+		logf("info", logFields{Operation: "restore"}, "%s", line)
+	}
+	if *dryRun {
+		logf("info", logFields{Operation: "restore"}, "Dry run, %d changes not written", len(lines))
+		if len(lines) > 0 {
+			os.Exit(exitCodes[classDiff])
+		}
+		return
+	}
+
+	putConsulTree(target, "")
+	for _, key := range changes.removed {
+		deleteKey(key)
+	}
+	logf("info", logFields{Operation: "restore"}, "Restored %d keys from %s", b.Keys, filename)
+	summary.report()
+}
+
+// restoreKey maps the path of a value in a backup of the prefix to the key it
+// is restored to. Backups are rooted at the parent of their prefix.
+func restoreKey(prefix, to, p string) string {
+	switch {
+	case to == "":
+		parent := path.Dir(prefix)
+		if parent == "." || prefix == "" {
+			return p
+		}
+		return parent + "/" + p
+	case prefix == "":
+		return strings.TrimSuffix(to, "/") + "/" + p
+	}
+
+	// replace the last segment of the prefix with the new prefix
+	rest := ""
+	if i := strings.Index(p, "/"); i >= 0 {
+		rest = p[i:]
+	}
+	return strings.TrimSuffix(to, "/") + rest
+}
+
+// kvChanges are the keys a restore creates, updates and deletes, each sorted.
+type kvChanges struct {
+	added   []string
+	changed []string
+	removed []string
+}
+
+// lines describes the changes with a sorted line per key that is created
+// ("+"), updated ("~") or deleted ("-").
+func (c kvChanges) lines() []string {
+	lines := []string{}
+	for _, key := range c.added {
+		lines = append(lines, "+ "+key)
+	}
+	for _, key := range c.changed {
+		lines = append(lines, "~ "+key)
+	}
+	for _, key := range c.removed {
+		lines = append(lines, "- "+key)
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+// diffConsul compares the values that will be written with what is stored
+// under the prefix, finding the keys that are created, updated or, when
+// pruning, deleted.
+func diffConsul(values map[string]interface{}, prefix string, prune bool) kvChanges {
+	return compareKeys(values, existingKeys([]string{prefix}), prune)
+}
+
+// compareKeys compares the values that will be written with the existing
+// ones. The chunks of a key that is written are never deleted by pruning, as
+// writing the key replaces them itself.
+func compareKeys(values, existing map[string]interface{}, prune bool) kvChanges {
+	changes := kvChanges{}
+	for key, v := range values {
+		old, ok := existing[key]
+		if !ok {
+			changes.added = append(changes.added, key)
+		} else if !sameValue(old, v) {
+			changes.changed = append(changes.changed, key)
+		}
+	}
+	if prune {
+		for key := range existing {
+			if _, ok := values[key]; ok {
+				continue
+			}
+			if base, ok := chunkBase(key); ok {
+				_, plain := values[base]
+				_, chunked := values[chunkManifestKey(base)]
+				if plain || chunked {
+					continue
+				}
+			}
+			changes.removed = append(changes.removed, key)
+		}
+	}
+
+	sort.Strings(changes.added)
+	sort.Strings(changes.changed)
+	sort.Strings(changes.removed)
+	return changes
+}
+
+// deleteKey removes a single key from Consul. The function exits, reporting
+// the run, if the key cannot be deleted.
+func deleteKey(key string) {
+	if _, err := destKV.Delete(key, nil); err != nil {
+		summary.Failed.addListed(key)
+		summary.report()
+		consulFailed("delete", key, err, "Failed to delete from Consul, %s => {%s}", key, err)
+	}
+	summary.Deleted.add(key)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPruneBackups(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backups")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// two backups a day for the last three weeks
+	now := time.Date(2015, 3, 11, 12, 0, 0, 0, time.UTC)
+	for day := 0; day < 21; day++ {
+		for _, hour := range []int{0, 6} {
+			stamp := now.AddDate(0, 0, -day).Add(-time.Duration(hour) * time.Hour).Format(backupTimeFormat)
+			if err := ioutil.WriteFile(filepath.Join(dir, "app-"+stamp+".json"), []byte("{}"), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	pruneBackups(dir, "app", 3, 2, 3)
+
+	files, _ := filepath.Glob(filepath.Join(dir, "app-*.json"))
+	names := []string{}
+	for _, file := range files {
+		names = append(names, filepath.Base(file))
+	}
+	sort.Strings(names)
+
+	expected := []string{
+		"app-20150301T120000Z.json", // last of the week before last
+		"app-20150308T120000Z.json", // last of last week
+		"app-20150310T120000Z.json", // last of yesterday
+		"app-20150311T060000Z.json", // one of the three most recent
+		"app-20150311T120000Z.json", // most recent, today and this week
+	}
+	if len(names) != len(expected) {
+		t.Fatalf("Expected: %v\nRecieved: %v", expected, names)
+	}
+	for i := range expected {
+		if names[i] != expected[i] {
+			t.Errorf("Expected: %s\nRecieved: %s", expected[i], names[i])
+		}
+	}
+}
+
+func TestBackupName(t *testing.T) {
+	names := map[string]string{}
+	for _, prefix := range []string{"", "root", "a/b", "a_b", "a b", "app/"} {
+		name := backupName(prefix)
+		if other, ok := names[name]; ok {
+			t.Errorf("Expected distinct names, %q and %q are both %s", other, prefix, name)
+		}
+		names[name] = prefix
+
+		if prefix == "" {
+			continue
+		}
+		if unescaped, err := unescapeFileName(name); err != nil || unescaped != prefix {
+			t.Errorf("Expected %s to unescape to %q, recieved: %q (%v)", name, prefix, unescaped, err)
+		}
+	}
+}
+
+func TestCompareKeysChunked(t *testing.T) {
+	big := strings.Repeat("x", consulValueLimit+1)
+	values := map[string]interface{}{"r/cfg/big": big, "r/cfg/small": "y"}
+	splitValue(values, "r/cfg/big")
+
+	existing := map[string]interface{}{"r/cfg/gone": "z", "r/cfg/big/_chunk/2": "stale"}
+	for key, v := range values {
+		existing[key] = v
+	}
+
+	changes := compareKeys(values, existing, true)
+	if len(changes.added) != 0 || len(changes.changed) != 0 {
+		t.Errorf("Expected the chunked store to match, recieved: %v", changes.lines())
+	}
+	if !reflect.DeepEqual(changes.removed, []string{"r/cfg/gone"}) {
+		t.Errorf("Expected only r/cfg/gone to be pruned, recieved: %v", changes.removed)
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// consulValueLimit is the largest value Consul accepts for a key.
+	consulValueLimit = 512 * 1024
+	// chunkFolder is the folder below a key holding its value in chunks.
+	chunkFolder = "_chunk"
+	// chunkManifestName is the key in the chunk folder describing the chunks.
+	chunkManifestName = "manifest"
+)
+
+// chunkValues splits values over the size limit into chunks when writing.
+var chunkValues bool
+
+// chunkManifest describes a value stored in chunks.
+type chunkManifest struct {
+	Chunks int    `json:"chunks"`
+	Size   int    `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// replacedValue stands in for an existing value that is not compared: one
+// stored the other way, in chunks when it is now written as a plain value or
+// the other way around, or one that was not read. The value written in its
+// place is never unchanged.
+type replacedValue struct{}
+
+// oversizedKeys returns the keys whose values are over the size limit, in
+// order.
+func oversizedKeys(values map[string]interface{}) []string {
+	keys := []string{}
+	for key, v := range values {
+		if len(resolveBytes(leafValue(v))) > consulValueLimit {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// checkValueSizes ensures every value fits in Consul before anything is
+// written, unless values are chunked. The function exits listing every value
+// over the limit.
+func checkValueSizes(values map[string]interface{}) {
+	sizes := map[string]int{}
+	for _, key := range oversizedKeys(values) {
+		sizes[key] = len(resolveBytes(leafValue(values[key])))
+	}
+	refuseOversized(sizes)
+}
+
+// refuseOversized exits listing the sizes of the values over the limit,
+// unless values are chunked.
+func refuseOversized(sizes map[string]int) {
+	if len(sizes) == 0 || chunkValues {
+		return
+	}
+
+	keys := []string{}
+	for key := range sizes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		logf("error", logFields{Key: key, Operation: "write", ErrorClass: classValidation}, "Value too large, %s is %s", key, formatBytes(sizes[key]))
+	}
+	fatal(classValidation, logFields{}, "%d values are over Consul's limit of %s, use -chunk to store them in chunks", len(keys), formatBytes(consulValueLimit))
+}
+
+// chunk replaces the values over the size limit with chunks stored below
+// them, key/_chunk/0 onwards, and a manifest at key/_chunk/manifest. The
+// flags of an entry are kept on the manifest. The chunk folder name is
+// reserved, so no other key written holds it.
+func chunk(values map[string]interface{}) map[string]interface{} {
+	for _, key := range oversizedKeys(values) {
+		logf("info", logFields{Key: key, Operation: "write"}, "Storing %s in %d chunks", key, splitValue(values, key))
+	}
+	return values
+}
+
+// splitValue replaces the value of a key with its chunks and manifest,
+// returning the number of chunks.
+func splitValue(values map[string]interface{}, key string) int {
+	original := values[key]
+	data := resolveBytes(leafValue(original))
+	delete(values, key)
+
+	m := chunkManifest{Size: len(data), SHA256: checksum(data)}
+	for start := 0; start < len(data); start += consulValueLimit {
+		end := start + consulValueLimit
+		if end > len(data) {
+			end = len(data)
+		}
+		values[fmt.Sprintf("%s/%s/%d", key, chunkFolder, m.Chunks)] = binaryValue(data[start:end])
+		m.Chunks++
+	}
+
+	encoded, err := json.Marshal(m)
+	if err != nil {
+		fatalf("Error marshaling data for JSON => {%s}", err)
+	}
+	if e, ok := original.(entry); ok {
+		values[chunkManifestKey(key)] = entry{Value: string(encoded), Flags: e.Flags}
+	} else {
+		values[chunkManifestKey(key)] = string(encoded)
+	}
+	return m.Chunks
+}
+
+// chunkManifestKey returns the key of the manifest of a key stored in chunks.
+func chunkManifestKey(key string) string {
+	return key + "/" + chunkFolder + "/" + chunkManifestName
+}
+
+// chunkBase returns the key a chunk or manifest belongs to, when the key is in
+// a chunk folder.
+func chunkBase(key string) (string, bool) {
+	folder := strings.LastIndex(key, "/"+chunkFolder+"/")
+	if folder < 0 || strings.Contains(key[folder+len(chunkFolder)+2:], "/") {
+		return "", false
+	}
+	return key[:folder], true
+}
+
+// hasChunkSegment reports whether a key uses the name reserved for chunk
+// folders as one of its segments.
+func hasChunkSegment(key string) bool {
+	for _, segment := range strings.Split(key, "/") {
+		if segment == chunkFolder {
+			return true
+		}
+	}
+	return false
+}
+
+// takeStale removes from the existing values the keys left by storing a value
+// the other way: the chunks of a key now written as a plain value or in other
+// chunks, and the plain value of a key now stored in chunks. Each is returned
+// with the key written in its place, which counts as existing so the
+// conflict strategy applies to it.
+func takeStale(values, existing map[string]interface{}) map[string]string {
+	stale := map[string]string{}
+	for key := range existing {
+		if _, ok := values[key]; ok {
+			continue
+		}
+		base, inChunks := chunkBase(key)
+		if !inChunks {
+			base = key
+		}
+		if _, ok := values[base]; ok && inChunks {
+			stale[key] = base
+		} else if _, ok := values[chunkManifestKey(base)]; ok {
+			stale[key] = chunkManifestKey(base)
+		}
+	}
+
+	for key, replacement := range stale {
+		if _, ok := existing[replacement]; !ok {
+			existing[replacement] = replacedValue{}
+		}
+		delete(existing, key)
+	}
+	return stale
+}
+
+// deleteStale deletes the keys left by storing values the other way, unless
+// the existing values are skipped. Manifests go before their chunks so a
+// partial delete never leaves a manifest missing chunks.
+func deleteStale(stale map[string]string) {
+	if onConflict == "skip" {
+		return
+	}
+
+	keys := []string{}
+	for key := range stale {
+		keys = append(keys, key)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(keys)))
+	for _, key := range keys {
+		deleteKey(key)
+	}
+}
+
+// chunkKeys returns the keys stored in the chunk folder of a key.
+func chunkKeys(key string) []string {
+	folder := key + "/" + chunkFolder + "/"
+	keys, _, err := destKV.Keys(folder, "", nil)
+	if err != nil {
+		consulFailed("compare", folder, err, "Error retrieving data for specified key, %s => {%s}", folder, err)
+	}
+	return keys
+}
+
+// joinChunks replaces every chunk folder in the tree with the value stored in
+// it, which becomes the value of the folder's key. The function exits if the
+// chunks do not match their manifest.
+func (t tree) joinChunks(prefix string) {
+	for k, v := range t {
+		subTree, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		p := leafKey(prefix, k)
+		tree(subTree).joinChunks(p + "/")
+		chunks, ok := subTree[chunkFolder].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		manifestValue, ok := chunks[chunkManifestName]
+		if !ok {
+			continue
+		}
+
+		value := joinChunk(p, chunks, manifestValue)
+		delete(subTree, chunkFolder)
+		if len(subTree) == 0 || (len(subTree) == 1 && subTree[folderValue] != nil) {
+			// the chunked value replaces any value stored at the key itself
+			t[k] = value
+		} else {
+			subTree[folderValue] = value
+		}
+	}
+}
+
+// joinChunk reassembles the value of a key from its chunks.
+func joinChunk(key string, chunks map[string]interface{}, manifestValue interface{}) interface{} {
+	m := chunkManifest{}
+	if err := json.Unmarshal(resolveBytes(leafValue(manifestValue)), &m); err != nil {
+		fatalf("Invalid chunk manifest, %s => {%s}", key, err)
+	}
+
+	data := []byte{}
+	for i := 0; i < m.Chunks; i++ {
+		part, ok := chunks[strconv.Itoa(i)]
+		if !ok {
+			fatalf("Missing chunk %d of %s", i, key)
+		}
+		data = append(data, resolveBytes(leafValue(part))...)
+	}
+	if len(data) != m.Size || checksum(data) != m.SHA256 {
+		fatalf("Chunks of %s do not match their manifest", key)
+	}
+
+	if e, ok := manifestValue.(entry); ok {
+		e.Value = bytesValue(data)
+		return e
+	}
+	return bytesValue(data)
+}
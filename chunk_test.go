@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestChunkRoundTrip(t *testing.T) {
+	big := bytes.Repeat([]byte("0123456789abcdef"), consulValueLimit/8+3)
+	values := map[string]interface{}{
+		"app/bundle":       string(big),
+		"app/bundle/extra": "x",
+		"app/cert":         entry{Value: string(big[:consulValueLimit+1]), Flags: 9},
+		"app/small":        "y",
+	}
+	if keys := oversizedKeys(values); len(keys) != 2 || keys[0] != "app/bundle" || keys[1] != "app/cert" {
+		t.Fatalf("Expected the bundle and cert to be over the limit, recieved: %v", keys)
+	}
+
+	chunked := chunk(values)
+	if len(oversizedKeys(chunked)) != 0 {
+		t.Errorf("Expected every chunk to fit, recieved: %v", oversizedKeys(chunked))
+	}
+	if _, ok := chunked["app/bundle/_chunk/2"]; !ok {
+		t.Errorf("Expected three chunks of the bundle, recieved: %v", sortedKeys(chunked))
+	}
+
+	loaded := tree{}
+	for key, v := range chunked {
+		loaded.add(key, v)
+	}
+	loaded.joinChunks("")
+	leaves := loaded.flatten()
+
+	if len(leaves) != 4 {
+		t.Errorf("Expected the chunks to be joined, recieved: %v", sortedKeys(leaves))
+	}
+	if !bytes.Equal(resolveBytes(leaves["app/bundle"]), big) || leaves["app/bundle/extra"] != "x" {
+		t.Errorf("Expected the bundle to be reassembled")
+	}
+	if e, ok := leaves["app/cert"].(entry); !ok || e.Flags != 9 || len(resolveBytes(e.Value)) != consulValueLimit+1 {
+		t.Errorf("Expected the cert to keep its flags, recieved: %T", leaves["app/cert"])
+	}
+}
+
+func TestTakeStale(t *testing.T) {
+	values := map[string]interface{}{
+		"app/bundle":               "small now",
+		"app/cert/_chunk/0":        "a",
+		"app/cert/_chunk/manifest": "{}",
+		"app/other":                "y",
+	}
+	existing := map[string]interface{}{
+		"app/bundle/_chunk/0":        "a",
+		"app/bundle/_chunk/manifest": "{}",
+		"app/cert":                   "old",
+		"app/cert/_chunk/0":          "a",
+		"app/cert/_chunk/1":          "b",
+		"app/other/_chunk":           "not a chunk folder",
+	}
+
+	stale := takeStale(values, existing)
+	expected := map[string]string{
+		"app/bundle/_chunk/0":        "app/bundle",
+		"app/bundle/_chunk/manifest": "app/bundle",
+		"app/cert":                   "app/cert/_chunk/manifest",
+		"app/cert/_chunk/1":          "app/cert/_chunk/manifest",
+	}
+	if len(stale) != len(expected) {
+		t.Fatalf("Expected %v to be stale, recieved: %v", expected, stale)
+	}
+	for key, replacement := range expected {
+		if stale[key] != replacement {
+			t.Errorf("Expected %s to be replaced by %s, recieved: %q", key, replacement, stale[key])
+		}
+	}
+
+	write, _ := resolveConflicts("overwrite", values, existing)
+	if _, ok := write["app/bundle"]; !ok {
+		t.Errorf("Expected the plain value to replace the chunks")
+	}
+	if _, ok := write["app/cert/_chunk/manifest"]; !ok {
+		t.Errorf("Expected the manifest to replace the plain value")
+	}
+	if _, ok := write["app/cert/_chunk/0"]; ok {
+		t.Errorf("Expected the unchanged chunk to be kept")
+	}
+}
+
+func TestHasChunkSegment(t *testing.T) {
+	cases := map[string]bool{
+		"app/_chunk":          true,
+		"_chunk/app":          true,
+		"app/_chunk/manifest": true,
+		"app/_chunks":         false,
+		"app/chunk":           false,
+	}
+	for key, expected := range cases {
+		if hasChunkSegment(key) != expected {
+			t.Errorf("Expected %t for %s", expected, key)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"os"
+	"sort"
+	"strings"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+// onConflict is the strategy used for keys that already exist at the
+// destination: overwrite, skip, fail or merge.
+var onConflict string
+
+// checkOnConflict ensures the conflict strategy is one that is understood.
+// Consul keeps every key separately, so writing over it never removes the
+// keys only it has and "merge" there is the same as "overwrite".
+func checkOnConflict() {
+	switch onConflict {
+	case "overwrite", "skip", "fail", "merge":
+	default:
+		usageErrorf("Invalid conflict strategy, %s, expected overwrite, skip, fail or merge", onConflict)
+	}
+}
+
+// sameValue reports whether two leaves hold the same value and flags.
+func sameValue(a, b interface{}) bool {
+	if _, ok := a.(replacedValue); ok {
+		return false
+	}
+	var aFlags, bFlags uint64
+	if e, ok := a.(entry); ok {
+		a, aFlags = e.Value, e.Flags
+	}
+	if e, ok := b.(entry); ok {
+		b, bFlags = e.Value, e.Flags
+	}
+	return aFlags == bFlags && string(resolveBytes(a)) == string(resolveBytes(b))
+}
+
+// resolveConflicts decides which of the values are written to a destination
+// already holding the existing values, recording the outcome for every key in
+// the summary. Unchanged values are not written again. With "fail" nothing is
+// written and the keys that already exist are returned instead.
+func resolveConflicts(strategy string, values, existing map[string]interface{}) (map[string]interface{}, []string) {
+	conflicts := []string{}
+	for key := range values {
+		if _, ok := existing[key]; ok {
+			conflicts = append(conflicts, key)
+		}
+	}
+	sort.Strings(conflicts)
+	if strategy == "fail" && len(conflicts) > 0 {
+		return nil, conflicts
+	}
+
+	write := map[string]interface{}{}
+	for _, key := range sortedKeys(values) {
+		v := values[key]
+		old, ok := existing[key]
+		switch {
+		case !ok:
+			summary.Created.add(key)
+			write[key] = v
+		case strategy == "skip":
+			summary.Skipped.addListed(key)
+		case sameValue(old, v):
+			summary.Unchanged.add(key)
+		default:
+			summary.Updated.add(key)
+			write[key] = v
+		}
+	}
+	for _, key := range sortedKeys(existing) {
+		if _, ok := values[key]; !ok {
+			summary.Kept.add(key)
+		}
+	}
+	return write, nil
+}
+
+// refuseConflicts exits, listing the keys that already exist at the
+// destination, when the strategy forbids writing over them.
+func refuseConflicts(conflicts []string) {
+	for _, key := range conflicts {
+		logf("error", logFields{Key: key, Operation: "write", Datacenter: destDatacenter, ErrorClass: classConflict}, "Key already exists, %s", key)
+	}
+	fatal(classConflict, logFields{Operation: "write", Datacenter: destDatacenter}, "Refusing to write, %d keys already exist at the destination", len(conflicts))
+}
+
+// mergeFile combines the values with those already in a destination file,
+// which is read by the given function when it exists. Overwriting replaces
+// the file outright without reading it, so its keys are counted as replaced
+// rather than created or updated; the other strategies keep the keys only in
+// the file. Nothing exists on stdout.
+func mergeFile(values tree, filename string, read func(string) tree) tree {
+	if _, err := os.Stat(filename); filename == stdio || os.IsNotExist(err) {
+		summary.Created.add(sortedKeys(values.flatten())...)
+		return values
+	}
+	if onConflict == "overwrite" {
+		summary.Replaced.add(sortedKeys(values.flatten())...)
+		return values
+	}
+	existing := read(filename).flatten()
+
+	write, conflicts := resolveConflicts(onConflict, values.flatten(), existing)
+	if conflicts != nil {
+		refuseConflicts(conflicts)
+	}
+
+	merged := tree{}
+	for key, v := range existing {
+		merged.add(key, v)
+	}
+	for key, v := range write {
+		merged.add(key, v)
+	}
+	return merged
+}
+
+// existingKeys returns the values stored in Consul below each of the
+// prefixes. Only keys in a prefix's folder belong to it.
+func existingKeys(prefixes []string) map[string]interface{} {
+	existing := map[string]interface{}{}
+	for _, prefix := range prefixes {
+		pairs, _, err := destKV.List(prefix, nil)
+		if err != nil {
+			consulFailed("compare", prefix, err, "Error retrieving data for specified key, %s => {%s}", prefix, err)
+		}
+
+		folder := strings.TrimSuffix(prefix, "/") + "/"
+		for _, pair := range pairs {
+			if prefix == "" || pair.Key == prefix || strings.HasPrefix(pair.Key, folder) {
+				existing[pair.Key] = existingEntry(pair)
+			}
+		}
+	}
+	return existing
+}
+
+// existingKey returns the value stored in Consul at a single key, if any.
+func existingKey(key string) map[string]interface{} {
+	existing := map[string]interface{}{}
+	pair, _, err := destKV.Get(key, nil)
+	if err != nil {
+		consulFailed("compare", key, err, "Error retrieving data for specified key, %s => {%s}", key, err)
+	}
+	if pair != nil {
+		existing[key] = existingEntry(pair)
+	}
+	return existing
+}
+
+// existingEntry returns the value of a pair as compared with the values written.
+func existingEntry(pair *consul.KVPair) entry {
+	return entry{Value: string(pair.Value), Flags: pair.Flags}
+}
+
+// sortedKeys returns the keys of a flattened tree in order.
+func sortedKeys(leaves map[string]interface{}) []string {
+	keys := []string{}
+	for key := range leaves {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
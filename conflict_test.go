@@ -0,0 +1,75 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestResolveConflicts(t *testing.T) {
+	defer func() { summary = runSummary{} }()
+
+	values := map[string]interface{}{
+		"app/new":     "1",
+		"app/same":    "2",
+		"app/changed": "3",
+		"app/flagged": entry{Value: "4", Flags: 7},
+	}
+	existing := map[string]interface{}{
+		"app/same":    entry{Value: "2"},
+		"app/changed": entry{Value: "tuned"},
+		"app/flagged": entry{Value: "4"},
+		"app/other":   entry{Value: "5"},
+	}
+
+	cases := []struct {
+		strategy string
+		written  []string
+		skipped  int
+	}{
+		{"overwrite", []string{"app/changed", "app/flagged", "app/new"}, 0},
+		{"merge", []string{"app/changed", "app/flagged", "app/new"}, 0},
+		{"skip", []string{"app/new"}, 3},
+	}
+	for _, c := range cases {
+		summary = runSummary{}
+		write, conflicts := resolveConflicts(c.strategy, values, existing)
+		if conflicts != nil {
+			t.Errorf("Unexpected conflicts with %s: %v", c.strategy, conflicts)
+		}
+		if keys := sortedKeys(write); !reflect.DeepEqual(keys, c.written) {
+			t.Errorf("Expected %v to be written with %s, recieved: %v", c.written, c.strategy, keys)
+		}
+		if summary.Created.count != 1 || summary.Skipped.count != c.skipped || summary.Kept.count != 1 {
+			t.Errorf("Unexpected outcomes with %s: %+v", c.strategy, summary)
+		}
+	}
+
+	summary = runSummary{}
+	write, conflicts := resolveConflicts("fail", values, existing)
+	if write != nil || !reflect.DeepEqual(conflicts, []string{"app/changed", "app/flagged", "app/same"}) {
+		t.Errorf("Expected existing keys to be refused, recieved: %v %v", write, conflicts)
+	}
+}
+
+func TestMergeFileOverwriteSkipsRead(t *testing.T) {
+	defer func() { summary = runSummary{} }()
+
+	file, err := ioutil.TempFile("", "conflict")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString("not json")
+	file.Close()
+	defer os.Remove(file.Name())
+
+	values := tree{"app": map[string]interface{}{"port": "80"}}
+	merged := mergeFile(values, file.Name(), func(string) tree {
+		t.Fatal("Expected the file not to be read when overwriting")
+		return nil
+	})
+	if !reflect.DeepEqual(merged, values) || summary.Replaced.count != 1 || summary.Updated.count != 0 {
+		t.Errorf("Expected the values to replace the file, recieved: %v %+v", merged, summary)
+	}
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const (
+	// encryptedPrefix and encryptedSuffix surround an encrypted value.
+	encryptedPrefix = "ENC["
+	encryptedSuffix = "]"
+
+	// passphraseEnv and newPassphraseEnv hold the passphrases used when no key
+	// file is given.
+	passphraseEnv    = "CONSUL_LOADER_PASSPHRASE"
+	newPassphraseEnv = "CONSUL_LOADER_NEW_PASSPHRASE"
+
+	keySize          = 32
+	saltSize         = 16
+	gcmNonceSize     = 12
+	gcmTagSize       = 16
+	pbkdf2Iterations = 100000
+)
+
+// decrypted holds the paths of the values read encrypted, which are masked
+// wherever values are shown.
+var decrypted = map[string]bool{}
+
+// secretKey encrypts and decrypts values with AES-256-GCM. The key is either
+// read from a key file or derived from a passphrase; derived keys are salted
+// per run and the salt is stored with every value.
+type secretKey struct {
+	key        []byte
+	passphrase []byte
+	salt       []byte
+	derived    map[string][]byte
+}
+
+// loadSecretKey reads the key from a key file, which holds 32 bytes either
+// raw or base64 encoded, or else from the passphrase in the environment
+// variable. It returns nil if neither is set.
+func loadSecretKey(keyFile, env string) *secretKey {
+	if keyFile != "" {
+		data, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			fatalf("Failed to read key file, %s => {%s}", keyFile, err)
+		}
+
+		if decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data))); err == nil {
+			data = decoded
+		}
+		if len(data) != keySize {
+			usageErrorf("Key file must hold a %d byte key, %s", keySize, keyFile)
+		}
+		return &secretKey{key: data}
+	}
+
+	if passphrase := os.Getenv(env); passphrase != "" {
+		salt := make([]byte, saltSize)
+		if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+			fatalf("Failed to generate salt => {%s}", err)
+		}
+		return &secretKey{passphrase: []byte(passphrase), salt: salt, derived: map[string][]byte{}}
+	}
+
+	return nil
+}
+
+// deriveKey returns the key derived from the passphrase with the given salt.
+func (k *secretKey) deriveKey(salt []byte) []byte {
+	key, ok := k.derived[string(salt)]
+	if !ok {
+		key = pbkdf2SHA256(k.passphrase, salt, pbkdf2Iterations, keySize)
+		k.derived[string(salt)] = key
+	}
+	return key
+}
+
+// encrypt seals the value at a path and returns it as a tagged string. The
+// path is authenticated with the value, so it cannot be copied to another key.
+func (k *secretKey) encrypt(plaintext []byte, path string) (string, error) {
+	mode, key, header := "key", k.key, []byte{}
+	if k.key == nil {
+		mode, key, header = "pass", k.deriveKey(k.salt), k.salt
+	}
+
+	aead, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+
+	sealed := aead.Seal(append(append([]byte{}, header...), nonce...), nonce, plaintext, []byte(path))
+	return fmt.Sprintf("%saes-gcm:%s:%s%s", encryptedPrefix, mode, base64.StdEncoding.EncodeToString(sealed), encryptedSuffix), nil
+}
+
+// decrypt opens a tagged string written by encrypt for the same path.
+func (k *secretKey) decrypt(value, path string) ([]byte, error) {
+	mode, sealed, ok := parseEncrypted(value)
+	if !ok {
+		return nil, fmt.Errorf("unknown encryption format")
+	}
+
+	var key []byte
+	switch mode {
+	case "key":
+		if k.key == nil {
+			return nil, fmt.Errorf("value was encrypted with a key file")
+		}
+		key = k.key
+	case "pass":
+		if k.passphrase == nil {
+			return nil, fmt.Errorf("value was encrypted with a passphrase")
+		}
+		key, sealed = k.deriveKey(sealed[:saltSize]), sealed[saltSize:]
+	}
+
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, sealed[:gcmNonceSize], sealed[gcmNonceSize:], []byte(path))
+}
+
+// parseEncrypted splits a tagged string written by encrypt into its key mode
+// and sealed bytes. It reports false unless the string has the full envelope
+// and its payload decodes to at least a salt, nonce and tag.
+func parseEncrypted(value string) (mode string, sealed []byte, ok bool) {
+	prefix := encryptedPrefix + "aes-gcm:"
+	if !strings.HasPrefix(value, prefix) || !strings.HasSuffix(value, encryptedSuffix) {
+		return "", nil, false
+	}
+	parts := strings.SplitN(value[len(prefix):len(value)-len(encryptedSuffix)], ":", 2)
+	if len(parts) != 2 {
+		return "", nil, false
+	}
+	sealed, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", nil, false
+	}
+
+	size := gcmNonceSize + gcmTagSize
+	switch parts[0] {
+	case "key":
+	case "pass":
+		size += saltSize
+	default:
+		return "", nil, false
+	}
+	return parts[0], sealed, len(sealed) >= size
+}
+
+// newGCM creates an AES-GCM cipher from a key.
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// pbkdf2SHA256 derives a key from a password as described in RFC 2898.
+func pbkdf2SHA256(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	key := []byte{}
+	for block := uint32(1); len(key) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.Write(prf, binary.BigEndian, block)
+		u := prf.Sum(nil)
+
+		t := append([]byte{}, u...)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
+
+// isEncrypted reports whether a value is a tagged encrypted string. Plain
+// values that merely look like "ENC[...]" are not.
+func isEncrypted(v interface{}) bool {
+	s, ok := v.(string)
+	if !ok {
+		return false
+	}
+	_, _, ok = parseEncrypted(s)
+	return ok
+}
+
+// encrypt returns a copy of the tree with the leaves whose paths match any of
+// the patterns encrypted. Leaves that are already encrypted are left as is.
+func (t tree) encrypt(key *secretKey, patterns []string, prefix string) tree {
+	result := tree{}
+	for k, v := range t {
+		p := leafKey(prefix, k)
+		if subTree, ok := v.(map[string]interface{}); ok {
+			result[k] = map[string]interface{}(tree(subTree).encrypt(key, patterns, p+"/"))
+		} else {
+			result[k] = encryptValue(key, patterns, p, v)
+		}
+	}
+	return result
+}
+
+// encryptValue encrypts the value at the path if it matches the patterns and
+// is not encrypted already.
+func encryptValue(key *secretKey, patterns []string, p string, v interface{}) interface{} {
+	if !matchAny(patterns, p) {
+		return v
+	}
+	if e, ok := v.(entry); ok {
+		if !isEncrypted(e.Value) {
+			e.Value = encryptLeaf(key, p, e.Value)
+		}
+		return e
+	}
+	if !isEncrypted(v) {
+		v = encryptLeaf(key, p, v)
+	}
+	return v
+}
+
+// encryptLeaf encrypts a single value. The function exits on failure.
+func encryptLeaf(key *secretKey, p string, v interface{}) string {
+	sealed, err := key.encrypt(resolveBytes(v), p)
+	if err != nil {
+		fatalf("Failed to encrypt value, %s => {%s}", p, err)
+	}
+	return sealed
+}
+
+// decrypt replaces the encrypted leaves of the tree with their plaintext.
+func (t tree) decrypt(key *secretKey, prefix string) {
+	for k, v := range t {
+		p := leafKey(prefix, k)
+		if subTree, ok := v.(map[string]interface{}); ok {
+			tree(subTree).decrypt(key, p+"/")
+		} else {
+			t[k] = decryptValue(key, p, v)
+		}
+	}
+}
+
+// decryptValue returns the plaintext of the value at the path if it is
+// encrypted, recording the path so the value is masked when shown.
+func decryptValue(key *secretKey, p string, v interface{}) interface{} {
+	if e, ok := v.(entry); ok {
+		if isEncrypted(e.Value) {
+			e.Value = decryptLeaf(key, p, e.Value.(string))
+			decrypted[p] = true
+		}
+		return e
+	}
+	if isEncrypted(v) {
+		v = decryptLeaf(key, p, v.(string))
+		decrypted[p] = true
+	}
+	return v
+}
+
+// decryptLeaf decrypts a single value. The function exits on failure.
+func decryptLeaf(key *secretKey, p string, value string) interface{} {
+	if key == nil {
+		usageErrorf("Value is encrypted but no key file or %s was given, %s", passphraseEnv, p)
+	}
+
+	plaintext, err := key.decrypt(value, p)
+	if err != nil {
+		fatalf("Failed to decrypt value, %s => {%s}", p, err)
+	}
+	return bytesValue(plaintext)
+}
+
+// rekey re-encrypts the encrypted values of JSON files with a new key,
+// leaving every other value untouched.
+func rekey(args []string) {
+	if len(args) == 0 {
+		usageErrorf("Usage: consul_loader [-keyFile old] -newKeyFile new rekey file.json...")
+	}
+
+	oldKey := loadSecretKey(keyFile, passphraseEnv)
+	newKey := loadSecretKey(newKeyFile, newPassphraseEnv)
+	if oldKey == nil || newKey == nil {
+		usageErrorf("Both the current and the new key must be given, by key file or by %s and %s", passphraseEnv, newPassphraseEnv)
+	}
+
+	for _, filename := range args {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			fatalf("Failed to read file, %s => {%s}", filename, err)
+		}
+		values := tree{}
+		if err := json.Unmarshal(data, &values); err != nil {
+			fatal(classValidation, logFields{Operation: "read"}, "Failed to decode json in file, %s => {%s}", filename, err)
+		}
+		values.decodeEntries()
+
+		count := values.rekey(oldKey, newKey, "")
+		writeJSONFile(values, filename)
+		logf("info", logFields{Operation: "rekey"}, "Rekeyed %d values in %s", count, filename)
+	}
+}
+
+// rekey re-encrypts every encrypted leaf of the tree with the new key and
+// returns how many there were.
+func (t tree) rekey(oldKey, newKey *secretKey, prefix string) (count int) {
+	for k, v := range t {
+		p := leafKey(prefix, k)
+		switch val := v.(type) {
+		case map[string]interface{}:
+			count += tree(val).rekey(oldKey, newKey, p+"/")
+		case entry:
+			if isEncrypted(val.Value) {
+				val.Value = encryptLeaf(newKey, p, decryptLeaf(oldKey, p, val.Value.(string)))
+				t[k] = val
+				count++
+			}
+		default:
+			if isEncrypted(v) {
+				t[k] = encryptLeaf(newKey, p, decryptLeaf(oldKey, p, v.(string)))
+				count++
+			}
+		}
+	}
+	return
+}
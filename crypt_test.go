@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/hex"
+	"os"
+	"testing"
+)
+
+func TestPBKDF2(t *testing.T) {
+	// test vector from RFC 7914, section 11
+	expected := "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"
+	key := hex.EncodeToString(pbkdf2SHA256([]byte("passwd"), []byte("salt"), 1, 64))
+	if key != expected {
+		t.Errorf("Expected: %s\nRecieved: %s", expected, key)
+	}
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	os.Setenv(passphraseEnv, "correct horse")
+	os.Setenv(newPassphraseEnv, "battery staple")
+	defer os.Unsetenv(passphraseEnv)
+	defer os.Unsetenv(newPassphraseEnv)
+
+	key := loadSecretKey("", passphraseEnv)
+	values := tree{
+		"db": map[string]interface{}{
+			"password": "hunter2",
+			"port":     float64(5432),
+		},
+	}
+
+	encrypted := values.encrypt(key, []string{"db/password"}, "")
+	db := encrypted["db"].(map[string]interface{})
+	if !isEncrypted(db["password"]) || db["port"] != float64(5432) {
+		t.Fatalf("Expected only the password to be encrypted, recieved: %v", db)
+	}
+
+	newKey := loadSecretKey("", newPassphraseEnv)
+	if count := encrypted.rekey(key, newKey, ""); count != 1 {
+		t.Errorf("Expected 1 rekeyed value, recieved: %d", count)
+	}
+	if _, err := key.decrypt(db["password"].(string), "db/password"); err == nil {
+		t.Error("Expected the old key to no longer decrypt the value")
+	}
+
+	encrypted.decrypt(newKey, "")
+	if db["password"] != "hunter2" {
+		t.Errorf("Expected: hunter2\nRecieved: %v", db["password"])
+	}
+}
+
+func TestIsEncrypted(t *testing.T) {
+	key := &secretKey{key: make([]byte, keySize)}
+	sealed, err := key.encrypt([]byte("hunter2"), "db/password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isEncrypted(sealed) {
+		t.Errorf("Expected %s to be encrypted", sealed)
+	}
+
+	for _, plain := range []string{"ENC[]", "ENC[staging]", "ENC[aes-gcm:key:not base64!]", "ENC[aes-gcm:key:aGk=]", "ENC[aes-gcm:rot13:" + sealed[len("ENC[aes-gcm:key:"):]} {
+		if isEncrypted(plain) {
+			t.Errorf("Expected %s to be a plain value", plain)
+		}
+	}
+}
+
+func TestEncryptedPathBound(t *testing.T) {
+	key := &secretKey{key: make([]byte, keySize)}
+	sealed, err := key.encrypt([]byte("hunter2"), "db/password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plaintext, err := key.decrypt(sealed, "db/password"); err != nil || string(plaintext) != "hunter2" {
+		t.Errorf("Expected the value to decrypt at its path, recieved: %q %v", plaintext, err)
+	}
+	if _, err := key.decrypt(sealed, "db/user"); err == nil {
+		t.Error("Expected the value copied to another path to fail to decrypt")
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// folderKeys returns the keys that have other keys below them.
+func folderKeys(leaves map[string]interface{}) map[string]bool {
+	folders := map[string]bool{}
+	for key := range leaves {
+		segments := strings.Split(key, "/")
+		for i := 1; i < len(segments); i++ {
+			folders[strings.Join(segments[:i], "/")] = true
+		}
+	}
+	return folders
+}
+
+// readDirTree constructs a tree from a directory holding one file per key.
+// Hidden files are not part of the format and are skipped. The function exits
+// if the directory cannot be read.
+func readDirTree(dir string) tree {
+	values := tree{}
+	dir = filepath.Clean(dir)
+
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == dir {
+			return nil
+		}
+		if strings.HasPrefix(info.Name(), ".") {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		key, err := fileNameKey(filepath.ToSlash(rel))
+		if err != nil {
+			return err
+		}
+
+		// empty directories are folder keys
+		if info.IsDir() {
+			if empty, err := isEmptyDir(p); err != nil || !empty {
+				return err
+			}
+			values.add(key+"/", "")
+			return nil
+		}
+
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		values.add(key, bytesValue(data))
+		return nil
+	})
+	if err != nil {
+		fatalf("Failed to read directory, %s => {%s}", dir, err)
+	}
+	values.decrypt(secrets, "")
+
+	return values
+}
+
+// dirTreeMarker is the hidden file marking a directory written by
+// writeDirTree. Only marked directories have their stale files removed.
+const dirTreeMarker = ".consul_loader"
+
+// writeDirTree writes a tree into a directory, one file per key, and removes
+// the files and directories left from earlier exports. Hidden files are left
+// alone. The function exits if the directory cannot be written, or if it holds
+// files but was not written by an earlier export.
+func writeDirTree(t tree, dir string) {
+	leaves := t.flatten()
+	dir = filepath.Clean(dir)
+
+	folders := folderKeys(leaves)
+	mode := outputMode()
+
+	if err := os.MkdirAll(dir, dirMode(mode)); err != nil {
+		fatalf("Failed to create directory, %s => {%s}", dir, err)
+	}
+	if err := markDir(dir, mode); err != nil {
+		usageErrorf("Refusing to export into %s, files in it would be removed => {%s}", dir, err)
+	}
+
+	written := map[string]bool{dir: true}
+	for key, v := range leaves {
+		if e, ok := v.(entry); ok {
+			v = e.Value
+		}
+
+		filename := filepath.Join(dir, filepath.FromSlash(keyFileName(key, folders[key])))
+		if strings.HasSuffix(key, "/") {
+			// folder keys are directories
+			dropFolderValue(key, v)
+			if err := os.MkdirAll(filename, dirMode(mode)); err != nil {
+				fatalf("Failed to create directory for key, %s => {%s}", key, err)
+			}
+		} else {
+			if err := os.MkdirAll(filepath.Dir(filename), dirMode(mode)); err != nil {
+				fatalf("Failed to create directory for key, %s => {%s}", key, err)
+			}
+			if err := writeFileAtomic(filename, resolveBytes(v), mode); err != nil {
+				fatalf("Failed to write file for key, %s => {%s}", key, err)
+			}
+		}
+
+		for p := filename; p != dir && p != "." && p != string(filepath.Separator); p = filepath.Dir(p) {
+			written[p] = true
+		}
+	}
+
+	pruneDir(dir, written)
+}
+
+// markDir ensures the directory can be pruned. A directory holding nothing but
+// hidden files is marked as written by writeDirTree; any other directory must
+// have been marked by an earlier export.
+func markDir(dir string, mode os.FileMode) error {
+	marker := filepath.Join(dir, dirTreeMarker)
+	if _, err := os.Stat(marker); err == nil {
+		return nil
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	empty, err := isEmptyDir(dir)
+	if err != nil {
+		return err
+	} else if !empty {
+		return fmt.Errorf("directory was not written by consul_loader, %s is missing", dirTreeMarker)
+	}
+	return ioutil.WriteFile(marker, []byte("Written by consul_loader, files not in the export are removed.\n"), mode)
+}
+
+// dropFolderValue warns that the value of a folder key is not kept, since
+// directories and archives store folder keys as directories.
+func dropFolderValue(key string, v interface{}) {
+	if !isEmptyValue(v) {
+		logf("warning", logFields{Key: key}, "folder keys are kept without their value in directories and archives, %s", key)
+	}
+}
+
+// isEmptyDir reports whether a directory holds nothing but hidden files.
+func isEmptyDir(dir string) (bool, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return false, err
+	}
+	for _, file := range files {
+		if !strings.HasPrefix(file.Name(), ".") {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// pruneDir removes every file and directory below dir that was not written,
+// deepest first, counting the files as deleted. Hidden files are kept, along
+// with the directories holding them.
+func pruneDir(dir string, written map[string]bool) {
+	stale := []string{}
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if p != dir && strings.HasPrefix(info.Name(), ".") {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !written[p] {
+			stale = append(stale, p)
+		}
+		return nil
+	})
+	if err != nil {
+		fatalf("Failed to read directory, %s => {%s}", dir, err)
+	}
+
+	// children sort after their parents
+	sort.Sort(sort.Reverse(sort.StringSlice(stale)))
+	for _, p := range stale {
+		info, err := os.Stat(p)
+		if err != nil {
+			fatalf("Failed to read stale file, %s => {%s}", p, err)
+		}
+
+		err = os.Remove(p)
+		if err != nil && !info.IsDir() {
+			fatalf("Failed to remove stale file, %s => {%s}", p, err)
+		}
+		if !info.IsDir() {
+			rel, _ := filepath.Rel(dir, p)
+			summary.Deleted.add(filepath.ToSlash(rel))
+		}
+	}
+}
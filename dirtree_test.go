@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDirTreeRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dirtree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// files from an earlier export, and a hidden file that is not part of it
+	ioutil.WriteFile(filepath.Join(dir, dirTreeMarker), nil, 0644)
+	os.MkdirAll(filepath.Join(dir, "stale"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "stale", "key"), []byte("old"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, ".gitignore"), []byte("*.tmp"), 0644)
+
+	values := tree{
+		"routes": map[string]interface{}{
+			"api": map[string]interface{}{"v1.0": "/v1"},
+		},
+		"weird key%": binaryValue{0, 1, 0xff},
+		".env":       "prod",
+	}
+	writeDirTree(values, dir)
+
+	if _, err := os.Stat(filepath.Join(dir, "stale")); !os.IsNotExist(err) {
+		t.Error("Expected stale files to be pruned")
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".gitignore")); err != nil {
+		t.Error("Expected hidden files to be kept")
+	}
+
+	loaded := readDirTree(dir)
+	leaves, expected := loaded.flatten(), values.flatten()
+	if len(leaves) != len(expected) {
+		t.Fatalf("Expected: %v\nRecieved: %v", expected, leaves)
+	}
+	for key, v := range expected {
+		if !sameValue(leaves[key], v) {
+			t.Errorf("Expected %s to be %q, recieved: %q", key, v, leaves[key])
+		}
+	}
+}
+
+func TestMarkDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dirtree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a directory holding only hidden files is claimed
+	ioutil.WriteFile(filepath.Join(dir, ".gitignore"), []byte("*.tmp"), 0644)
+	if err := markDir(dir, 0644); err != nil {
+		t.Fatalf("Expected the directory to be marked => {%s}", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, dirTreeMarker)); err != nil {
+		t.Errorf("Expected the marker to be written => {%s}", err)
+	}
+
+	// unrelated files are never pruned
+	other := filepath.Join(dir, "home")
+	os.MkdirAll(other, 0755)
+	ioutil.WriteFile(filepath.Join(other, "notes.txt"), []byte("keep"), 0644)
+	if err := markDir(other, 0644); err == nil {
+		t.Error("Expected a directory of unrelated files to be refused")
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Keys are escaped with a single scheme wherever a format cannot hold them as
+// they are: a reserved byte is written as %XX, its value in hex. File names
+// reserve every byte that is not safe in a path, and the names of a tree only
+// the few that would be mistaken for something else. Consul keys themselves
+// are never escaped; the API client percent-encodes them in request URLs.
+
+const (
+	// folderValueFile holds the value of a key that is also a folder. The
+	// escaping of file names never produces it, so it cannot collide with a key.
+	folderValueFile = "@value"
+	// emptySegmentFile stands for an empty segment of a key, as in "a//b".
+	emptySegmentFile = "@empty"
+)
+
+// escapeBytes writes the reserved bytes of a segment as %XX.
+func escapeBytes(segment string, reserved func(i int, c byte) bool) string {
+	escaped := ""
+	for i := 0; i < len(segment); i++ {
+		c := segment[i]
+		if reserved(i, c) {
+			escaped += fmt.Sprintf("%%%02X", c)
+		} else {
+			escaped += string(c)
+		}
+	}
+	return escaped
+}
+
+// unescapeSegment reverses the escaping of a segment.
+func unescapeSegment(name string) (string, error) {
+	segment := []byte{}
+	for i := 0; i < len(name); i++ {
+		if name[i] != '%' {
+			segment = append(segment, name[i])
+			continue
+		}
+
+		if i+2 >= len(name) {
+			return "", fmt.Errorf("truncated escape in name, %s", name)
+		}
+		c, err := strconv.ParseUint(name[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", fmt.Errorf("invalid escape in name, %s", name)
+		}
+		segment = append(segment, byte(c))
+		i += 2
+	}
+	return string(segment), nil
+}
+
+// escapeSegment turns one segment of a key into a file name. Bytes other than
+// letters, digits, "-", "_" and "." are escaped, as is a leading "." so that
+// no key becomes a hidden file, "." or "..".
+func escapeSegment(segment string) string {
+	if segment == "" {
+		return emptySegmentFile
+	}
+	return escapeBytes(segment, func(i int, c byte) bool {
+		safe := c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.'
+		return !safe || (i == 0 && c == '.')
+	})
+}
+
+// unescapeFileName reverses escapeSegment.
+func unescapeFileName(name string) (string, error) {
+	if name == emptySegmentFile {
+		return "", nil
+	}
+	return unescapeSegment(name)
+}
+
+// reservedName reports whether a segment cannot be a name in a tree as it is:
+// it would be read as an escaped name, as a tagged field such as "$value", or
+// as the reserved child holding a folder's value.
+func reservedName(segment string) bool {
+	switch {
+	case strings.HasPrefix(segment, "%"), segment == folderValue:
+		return true
+	}
+	return isTagName(segment)
+}
+
+// isTagName reports whether a name is a tagged field, a "$" and a letter.
+func isTagName(name string) bool {
+	if len(name) < 2 || name[0] != '$' {
+		return false
+	}
+	c := name[1]
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// escapeName turns one segment of a key into a name in a tree, and so in a
+// JSON file. Names are escaped only when reserved, and then their first byte
+// and every "%" are, so that only escaped names start with "%".
+func escapeName(segment string) string {
+	if !reservedName(segment) {
+		return segment
+	}
+	return escapeBytes(segment, func(i int, c byte) bool {
+		return i == 0 || c == '%'
+	})
+}
+
+// unescapeName reverses escapeName. Names that are not valid escapes are kept
+// as they are.
+func unescapeName(name string) string {
+	if !strings.HasPrefix(name, "%") {
+		return name
+	}
+	segment, err := unescapeSegment(name)
+	if err != nil {
+		return name
+	}
+	return segment
+}
+
+// keyFileName returns the slash separated path of the file a key is stored
+// in. The value of a key that is also a folder goes in the folder's sidecar,
+// and a folder key, ending in "/", is a directory.
+func keyFileName(key string, isFolder bool) string {
+	folderKey := strings.HasSuffix(key, "/")
+	names := []string{}
+	for _, segment := range strings.Split(strings.TrimSuffix(key, "/"), "/") {
+		names = append(names, escapeSegment(segment))
+	}
+	if isFolder && !folderKey {
+		names = append(names, folderValueFile)
+	}
+
+	name := strings.Join(names, "/")
+	if folderKey {
+		name += "/"
+	}
+	return name
+}
+
+// fileNameKey returns the key stored in the file at the slash separated path.
+func fileNameKey(name string) (string, error) {
+	folderKey := strings.HasSuffix(name, "/")
+	names := strings.Split(strings.TrimSuffix(name, "/"), "/")
+	if names[len(names)-1] == folderValueFile {
+		names = names[:len(names)-1]
+	}
+
+	segments := []string{}
+	for _, name := range names {
+		segment, err := unescapeFileName(name)
+		if err != nil {
+			return "", err
+		}
+		segments = append(segments, segment)
+	}
+
+	key := strings.Join(segments, "/")
+	if folderKey {
+		key += "/"
+	}
+	return key, nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// trickyKeys are keys that collide with separators, file names or the
+// reserved names of the formats unless they are escaped.
+var trickyKeys = []string{
+	"routes/api/v1.0",
+	"weird key%20",
+	"100%",
+	"%41",
+	"a//b",
+	".hidden/.env",
+	"sidecar/@value",
+	"sidecar/@empty",
+	"folder/_value",
+	"folder/x",
+	"tags/$value",
+	"tags/$delete",
+	"tags/${VAR}",
+	"query/a?b#c",
+	"unicode/ключ",
+	"feature/",
+}
+
+func trickyTree() (tree, map[string]interface{}) {
+	values := tree{}
+	expected := map[string]interface{}{}
+	for _, key := range trickyKeys {
+		v := "value of " + key
+		if key[len(key)-1] == '/' {
+			v = ""
+		}
+		values.add(key, v)
+		expected[key] = v
+	}
+	return values, expected
+}
+
+func TestEscapeSegment(t *testing.T) {
+	cases := map[string]string{
+		"v1.0":       "v1.0",
+		"weird key%": "weird%20key%25",
+		".env":       "%2Eenv",
+		"..":         "%2E.",
+		"@value":     "%40value",
+		"a\\b:c":     "a%5Cb%3Ac",
+		"":           "@empty",
+	}
+
+	for segment, expected := range cases {
+		escaped := escapeSegment(segment)
+		if escaped != expected {
+			t.Errorf("Expected: %s\nRecieved: %s", expected, escaped)
+		}
+		if unescaped, err := unescapeFileName(escaped); err != nil || unescaped != segment {
+			t.Errorf("Expected: %s\nRecieved: %s (%v)", segment, unescaped, err)
+		}
+	}
+}
+
+func TestEscapeName(t *testing.T) {
+	cases := map[string]string{
+		"v1.0":         "v1.0",
+		"weird key%20": "weird key%20",
+		"%41":          "%2541",
+		"$value":       "%24value",
+		"${VAR}":       "${VAR}",
+		"_value":       "%5Fvalue",
+		"%x%":          "%25x%25",
+	}
+
+	for segment, expected := range cases {
+		escaped := escapeName(segment)
+		if escaped != expected {
+			t.Errorf("Expected: %s\nRecieved: %s", expected, escaped)
+		}
+		if unescaped := unescapeName(escaped); unescaped != segment {
+			t.Errorf("Expected: %s\nRecieved: %s", segment, unescaped)
+		}
+	}
+}
+
+func TestEscapedKeysRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "escape")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	values, expected := trickyTree()
+	if leaves := values.flatten(); !reflect.DeepEqual(leaves, expected) {
+		t.Fatalf("Expected: %v\nRecieved: %v", expected, leaves)
+	}
+
+	jsonFile := filepath.Join(dir, "values.json")
+	writeJSONFile(values, jsonFile)
+	if leaves := readJSONFile(jsonFile).flatten(); !reflect.DeepEqual(leaves, expected) {
+		t.Errorf("JSON round trip\nExpected: %v\nRecieved: %v", expected, leaves)
+	}
+
+	treeDir := filepath.Join(dir, "values")
+	writeDirTree(values, treeDir)
+	if leaves := readDirTree(treeDir).flatten(); !reflect.DeepEqual(leaves, expected) {
+		t.Errorf("Directory round trip\nExpected: %v\nRecieved: %v", expected, leaves)
+	}
+
+	archiveFile := filepath.Join(dir, "values.tar.gz")
+	writeArchive(values, archiveFile)
+	if leaves := readArchive(archiveFile).flatten(); !reflect.DeepEqual(leaves, expected) {
+		t.Errorf("Archive round trip\nExpected: %v\nRecieved: %v", expected, leaves)
+	}
+}
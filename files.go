@@ -0,0 +1,106 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// stdio names stdin as a source and stdout as a destination.
+const stdio = "-"
+
+// fileMode is the octal permission mode of the files written.
+var fileMode string
+
+// outputMode returns the permission mode of the files written. The function
+// exits if -mode is not an octal mode.
+func outputMode() os.FileMode {
+	mode, err := strconv.ParseUint(fileMode, 8, 32)
+	if err != nil || mode > 0777 {
+		usageErrorf("Invalid file mode, %s, expected an octal mode such as 0600", fileMode)
+	}
+	return os.FileMode(mode)
+}
+
+// dirMode returns the mode of the directories holding files of the mode,
+// which may be searched by whoever may read the files.
+func dirMode(mode os.FileMode) os.FileMode {
+	return mode | (mode&0444)>>2
+}
+
+// openInput opens a file for reading, or stdin for "-".
+func openInput(filename string) (io.ReadCloser, error) {
+	if filename == stdio {
+		return ioutil.NopCloser(os.Stdin), nil
+	}
+	return os.Open(filename)
+}
+
+// atomicFile is written in place of a file once it is complete. The data
+// goes to a hidden temporary file next to the file which is then renamed over
+// it, so readers never see a partly written file.
+type atomicFile struct {
+	io.Writer
+	temp     *os.File
+	filename string
+	mode     os.FileMode
+}
+
+// createAtomic starts writing a file with the mode, or stdout for "-".
+func createAtomic(filename string, mode os.FileMode) (*atomicFile, error) {
+	if filename == stdio {
+		return &atomicFile{Writer: os.Stdout}, nil
+	}
+
+	temp, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename)+".tmp")
+	if err != nil {
+		return nil, err
+	}
+	return &atomicFile{Writer: temp, temp: temp, filename: filename, mode: mode}, nil
+}
+
+// commit renames the complete file over the file being replaced.
+func (f *atomicFile) commit() error {
+	if f.temp == nil {
+		return nil
+	}
+
+	err := f.temp.Chmod(f.mode)
+	if err == nil {
+		err = f.temp.Sync()
+	}
+	if closeErr := f.temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.temp.Name(), f.filename)
+	}
+	if err != nil {
+		os.Remove(f.temp.Name())
+	}
+	return err
+}
+
+// abort removes the temporary file, leaving the file being replaced alone.
+func (f *atomicFile) abort() {
+	if f.temp != nil {
+		f.temp.Close()
+		os.Remove(f.temp.Name())
+	}
+}
+
+// writeFileAtomic writes data to a file with the mode, or to stdout for "-",
+// replacing the file at once.
+func writeFileAtomic(filename string, data []byte, mode os.FileMode) error {
+	f, err := createAtomic(filename, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.abort()
+		return err
+	}
+	return f.commit()
+}
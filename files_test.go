@@ -0,0 +1,46 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul_loader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "values.json")
+	if err := ioutil.WriteFile(filename, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFileAtomic(filename, []byte("new"), 0600); err != nil {
+		t.Fatalf("Failed to write file => {%s}", err)
+	}
+
+	info, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Expected mode 0600, recieved: %o", info.Mode().Perm())
+	}
+	if data, _ := ioutil.ReadFile(filename); string(data) != "new" {
+		t.Errorf("Expected the file to be replaced, recieved: %s", data)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("Expected the temporary file to be gone, recieved %d files", len(files))
+	}
+}
+
+func TestDirMode(t *testing.T) {
+	for file, dir := range map[os.FileMode]os.FileMode{0600: 0700, 0644: 0755, 0640: 0750} {
+		if mode := dirMode(file); mode != dir {
+			t.Errorf("Expected %o for files of %o, recieved: %o", dir, file, mode)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"strings"
+)
+
+// ignoreFile is read for exclude patterns when it exists in the working directory.
+const ignoreFile = ".consul_loader_ignore"
+
+// keyFilter decides which Consul keys take part in a run, using glob patterns
+// matched against whole keys. A "*" matches within a single segment of a key
+// and a "**" segment matches any number of segments. Patterns ending in "/"
+// match everything below that folder.
+type keyFilter struct {
+	include []string
+	exclude []string
+}
+
+var (
+	// exportFilter is applied to keys read from Consul.
+	exportFilter *keyFilter
+	// importFilter is applied to the paths of the values read from a file,
+	// directory or archive.
+	importFilter *keyFilter
+)
+
+// newKeyFilter creates a filter from the include and exclude patterns along
+// with those in the ignore file. It returns nil when there is nothing to
+// filter. The function exits if a pattern is malformed.
+func newKeyFilter(include, exclude []string) *keyFilter {
+	f := &keyFilter{}
+	for _, pattern := range include {
+		f.include = append(f.include, normalizePattern(pattern))
+	}
+	for _, pattern := range append(exclude, readIgnoreFile(ignoreFile)...) {
+		f.exclude = append(f.exclude, normalizePattern(pattern))
+	}
+
+	if len(f.include) == 0 && len(f.exclude) == 0 {
+		return nil
+	}
+	return f
+}
+
+// normalizePattern expands folder patterns and checks the pattern is well formed.
+func normalizePattern(pattern string) string {
+	if strings.HasSuffix(pattern, "/") {
+		pattern += "**"
+	}
+
+	for _, segment := range strings.Split(pattern, "/") {
+		if _, err := path.Match(segment, ""); err != nil {
+			usageErrorf("Invalid filter pattern, %s => {%s}", pattern, err)
+		}
+	}
+	return pattern
+}
+
+// readIgnoreFile returns the patterns listed in an ignore file, one per line.
+// Blank lines and lines starting with "#" are skipped. A missing file holds
+// no patterns.
+func readIgnoreFile(filename string) []string {
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		fatalf("Failed to open ignore file, %s => {%s}", filename, err)
+	}
+	defer file.Close()
+
+	patterns := []string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+	if err := scanner.Err(); err != nil {
+		fatalf("Failed to read ignore file, %s => {%s}", filename, err)
+	}
+
+	return patterns
+}
+
+// keep reports whether a key passes the filter. Keys that are filtered out are
+// recorded in the run summary. A nil filter keeps every key.
+func (f *keyFilter) keep(key string) bool {
+	if f == nil {
+		return true
+	}
+
+	kept := len(f.include) == 0 || matchAny(f.include, key)
+	if kept && matchAny(f.exclude, key) {
+		kept = false
+	}
+
+	if !kept {
+		summary.Filtered.add(key)
+	}
+	return kept
+}
+
+// filter returns the tree without the leaves the filter drops. The paths of
+// the leaves within the tree are matched, as when rewriting. A nil filter
+// keeps the whole tree.
+func (t tree) filter(f *keyFilter) tree {
+	if f == nil {
+		return t
+	}
+
+	leaves := t.flatten()
+	kept := tree{}
+	for _, key := range sortedKeys(leaves) {
+		if f.keep(key) {
+			kept.add(key, leaves[key])
+		}
+	}
+	return kept
+}
+
+// matchAny reports whether the key matches any of the patterns.
+func matchAny(patterns []string, key string) bool {
+	for _, pattern := range patterns {
+		if matchGlob(pattern, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchGlob reports whether the key matches the glob pattern.
+func matchGlob(pattern, key string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(key, "/"))
+}
+
+// matchSegments matches the segments of a key against the segments of a
+// pattern, letting a "**" segment consume any number of key segments.
+func matchSegments(pattern, key []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(key); i++ {
+				if matchSegments(pattern[1:], key[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(key) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], key[0]); !ok {
+			return false
+		}
+		pattern, key = pattern[1:], key[1:]
+	}
+
+	return len(key) == 0
+}
@@ -0,0 +1,63 @@
+package main
+
+import "testing"
+
+func TestMatchGlob(t *testing.T) {
+	cases := []struct {
+		pattern string
+		key     string
+		match   bool
+	}{
+		{"app/**", "app/db/host", true},
+		{"app/**", "apple/db", false},
+		{"app/secrets/**", "app/secrets", true},
+		{"app/secrets/**", "app/secrets/db/password", true},
+		{"*/tmp/*", "app/tmp/x", true},
+		{"*/tmp/*", "app/tmp/x/y", false},
+		{"**/tmp/*", "a/b/tmp/x", true},
+		{"app/*.json", "app/config.json", true},
+		{"app/*", "app/db/host", false},
+		{"app/db/host", "app/db/host", true},
+	}
+
+	for _, c := range cases {
+		if matchGlob(c.pattern, c.key) != c.match {
+			t.Errorf("Expected match of %s against %s to be %t", c.pattern, c.key, c.match)
+		}
+	}
+}
+
+func TestKeyFilter(t *testing.T) {
+	defer func() { summary = runSummary{} }()
+
+	f := newKeyFilter([]string{"app/"}, []string{"app/secrets/**", "*/tmp/*"})
+	kept := []string{}
+	for _, key := range []string{"app/db", "app/secrets/pw", "app/tmp/x", "other/key"} {
+		if f.keep(key) {
+			kept = append(kept, key)
+		}
+	}
+
+	if len(kept) != 1 || kept[0] != "app/db" {
+		t.Errorf("Expected only app/db to be kept, recieved: %v", kept)
+	}
+	if summary.Filtered.count != 3 {
+		t.Errorf("Expected 3 filtered keys, recieved: %v", summary.Filtered)
+	}
+}
+
+func TestTreeFilter(t *testing.T) {
+	defer func() { summary = runSummary{} }()
+
+	values := tree{"app": map[string]interface{}{
+		"db":      "x",
+		"secrets": map[string]interface{}{"pw": "y"},
+	}}
+	kept := values.filter(newKeyFilter(nil, []string{"app/secrets/**"})).flatten()
+	if len(kept) != 1 || kept["app/db"] != "x" {
+		t.Errorf("Expected only app/db to be kept, recieved: %v", kept)
+	}
+	if values.filter(nil)["app"] == nil {
+		t.Errorf("Expected a nil filter to keep the tree")
+	}
+}
@@ -3,10 +3,13 @@
 package main
 
 import (
+	"bytes"
+	"flag"
 	"io/ioutil"
 	"math/rand"
 	"os"
 	"path"
+	"reflect"
 	"strconv"
 	"testing"
 )
@@ -31,6 +34,12 @@ var (
 	expectedJSON = `{"key1":1,"key2":2,"subtree":{"key3":3}}`
 )
 
+func TestMain(m *testing.M) {
+	flag.Parse()
+	connect()
+	os.Exit(m.Run())
+}
+
 func randFile() string {
 	return path.Join(os.TempDir(), strconv.Itoa(rand.Intn(1000)))
 }
@@ -97,3 +106,161 @@ func TestConsulIntegration(t *testing.T) {
 
 	diffTree(tree{consulKey: map[string]interface{}(testTreeString)}, vals, t)
 }
+
+func TestMetadataRoundTrip(t *testing.T) {
+	exportMeta = true
+	defer func() { exportMeta = false }()
+
+	key := consulKey + "meta"
+	putConsulTree(tree{"schema": entry{Value: "v2", Flags: 42}}, key)
+	vals := readConsulTree(key)
+
+	tmpFile := randFile()
+	defer os.Remove(tmpFile)
+	writeJSONFile(vals, tmpFile)
+	loadedTree := readJSONFile(tmpFile)
+
+	subtree, ok := loadedTree[key].(map[string]interface{})
+	if !ok {
+		t.Fatalf("Read tree missing subtree, %s", key)
+	}
+	e, ok := subtree["schema"].(entry)
+	if !ok {
+		t.Fatalf("Expected an entry, recieved: %#v", subtree["schema"])
+	}
+	if e.Value != "v2" || e.Flags != 42 || e.ModifyIndex == 0 {
+		t.Errorf("Metadata not preserved: %#v", e)
+	}
+}
+
+func TestFolderValueRoundTrip(t *testing.T) {
+	key := consulKey + "folder"
+	values := tree{}
+	values.add("app", "root")
+	values.add("app/db", "primary")
+	values.add("app/db/host", "localhost")
+	putConsulTree(values, key)
+
+	vals := readConsulTree(key)
+	tmpFile := randFile()
+	defer os.Remove(tmpFile)
+	writeJSONFile(vals, tmpFile)
+	loadedTree := readJSONFile(tmpFile)
+
+	rename = true
+	defer func() { rename = false }()
+	putConsulTree(loadedTree, key+"copy")
+
+	expected := map[string]interface{}{
+		key + "copy/app":         "root",
+		key + "copy/app/db":      "primary",
+		key + "copy/app/db/host": "localhost",
+	}
+	copied := readConsulTree(key + "copy").flatten()
+	if len(copied) != len(expected) {
+		t.Errorf("Expected %v, recieved: %v", expected, copied)
+	}
+	for k, v := range expected {
+		if copied[k] != v {
+			t.Errorf("Expected %s to be %s, recieved: %v", k, v, copied)
+		}
+	}
+}
+
+func TestEscapedKeysConsulRoundTrip(t *testing.T) {
+	key := consulKey + "escape"
+	values, expected := trickyTree()
+	putConsulTree(values, key)
+
+	// empty segments cannot be written through the HTTP API
+	delete(expected, "a//b")
+
+	loaded := readConsulTree(key)[key].(map[string]interface{})
+	if leaves := tree(loaded).flatten(); !reflect.DeepEqual(leaves, expected) {
+		t.Errorf("Expected: %v\nRecieved: %v", expected, leaves)
+	}
+}
+
+func TestBinaryValueConsulRoundTrip(t *testing.T) {
+	key := consulKey + "binary"
+	blob := []byte{0x1f, 0x8b, 0x08, 0x00, 0xff, 0xfe}
+	putConsulTree(tree{"blob": binaryValue(blob)}, key)
+
+	vals := readConsulTree(key)
+	tmpFile := randFile()
+	defer os.Remove(tmpFile)
+	writeJSONFile(vals, tmpFile)
+	putConsulTree(readJSONFile(tmpFile), key+"copy")
+
+	pair, _, err := destKV.Get(key+"copy/"+key+"/blob", nil)
+	if err != nil || pair == nil {
+		t.Fatalf("Failed to read the copied value => {%v}", err)
+	}
+	if string(pair.Value) != string(blob) {
+		t.Errorf("Expected %v, recieved: %v", blob, pair.Value)
+	}
+}
+
+func TestChunkedConsulRoundTrip(t *testing.T) {
+	chunkValues = true
+	defer func() { chunkValues = false }()
+
+	key := consulKey + "chunk"
+	big := make([]byte, consulValueLimit*2+10)
+	for i := range big {
+		big[i] = byte(i)
+	}
+	putConsulTree(tree{"bundle": binaryValue(big)}, key)
+
+	leaves := readConsulTree(key).flatten()
+	if len(leaves) != 1 || !bytes.Equal(resolveBytes(leaves[key+"/bundle"]), big) {
+		t.Errorf("Expected the bundle to be reassembled, recieved: %v", sortedKeys(leaves))
+	}
+}
+
+func TestStreamedExportMatches(t *testing.T) {
+	key := consulKey + "stream"
+	values, _ := trickyTree()
+	values.add("app", "root")
+	values.add("app/db/host", "localhost")
+	values.add("app/bin", binaryValue{0xff, 0xfe})
+	putConsulTree(values, key)
+
+	expectedFile, streamedFile := randFile(), randFile()+"stream"
+	defer os.Remove(expectedFile)
+	defer os.Remove(streamedFile)
+	writeJSONFile(readConsulTree(key), expectedFile)
+	streamConsulTree(key, streamedFile)
+
+	expected, err := ioutil.ReadFile(expectedFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	streamed, err := ioutil.ReadFile(streamedFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(expected, streamed) {
+		t.Errorf("Expected: %s\nRecieved: %s", expected, streamed)
+	}
+}
+
+func TestStreamedImportMatches(t *testing.T) {
+	values, _ := trickyTree()
+	values.add("app", "root")
+	values.add("app/db/host", "localhost")
+	values.add("app/bin", binaryValue{0xff, 0xfe})
+
+	tmpFile := randFile()
+	defer os.Remove(tmpFile)
+	writeJSONFile(values, tmpFile)
+
+	putConsulTree(readJSONFile(tmpFile), consulKey+"imported")
+	streamJSONToConsul(tmpFile, consulKey+"streamed")
+
+	expected := readConsulTree(consulKey + "imported")[consulKey+"imported"]
+	streamed := readConsulTree(consulKey + "streamed")[consulKey+"streamed"]
+	if !reflect.DeepEqual(expected, streamed) {
+		t.Errorf("Expected: %v\nRecieved: %v", expected, streamed)
+	}
+}
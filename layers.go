@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// deleteTag marks an object in an overlay as the deletion of the inherited
+// key or folder, as in {"$delete": true}.
+const deleteTag = "$delete"
+
+// splitFiles returns the files named by flags that may be repeated or hold a
+// comma separated list.
+func splitFiles(flags []string) []string {
+	files := []string{}
+	for _, value := range flags {
+		for _, filename := range strings.Split(value, ",") {
+			if filename = strings.TrimSpace(filename); filename != "" {
+				files = append(files, filename)
+			}
+		}
+	}
+	return files
+}
+
+// isDeletion reports whether a value marks the deletion of an inherited key.
+func isDeletion(v interface{}) bool {
+	fields, ok := v.(map[string]interface{})
+	return ok && len(fields) == 1 && fields[deleteTag] == true
+}
+
+// readJSONLayers reads the files in order and deep-merges them, later files
+// overriding earlier ones. It also returns the file each leaf came from.
+func readJSONLayers(files []string) (tree, map[string]string) {
+	values := tree{}
+	origins := map[string]string{}
+	for _, filename := range files {
+		values.overlay(readJSONFile(filename), filename, "", origins)
+	}
+	return values, origins
+}
+
+// overlay deep-merges another tree into the tree, recording the file every
+// leaf it sets came from. Subtrees are merged, a value set where there is a
+// folder becomes the folder's own value, and a folder set where there is a
+// value keeps it as its own. A deletion removes the inherited key or folder.
+func (t tree) overlay(o tree, filename, prefix string, origins map[string]string) {
+	for k, v := range o {
+		p := leafKey(prefix, k)
+		if isDeletion(v) {
+			delete(t, k)
+			if k == folderValue && prefix != "" {
+				delete(origins, p)
+			} else {
+				forgetOrigins(origins, p)
+			}
+			continue
+		}
+
+		subTree, isTree := v.(map[string]interface{})
+		existing, hasTree := t[k].(map[string]interface{})
+		switch {
+		case isTree && hasTree:
+			tree(existing).overlay(subTree, filename, p+"/", origins)
+		case isTree:
+			merged := tree{}
+			if old, ok := t[k]; ok {
+				merged[folderValue] = old
+			}
+			merged.overlay(subTree, filename, p+"/", origins)
+			t[k] = map[string]interface{}(merged)
+		case hasTree:
+			existing[folderValue] = v
+			origins[p] = filename
+		default:
+			t[k] = v
+			origins[p] = filename
+		}
+
+		// folders emptied by deletions are removed, empty folders are kept
+		if merged, ok := t[k].(map[string]interface{}); ok && len(merged) == 0 && len(subTree) > 0 {
+			delete(t, k)
+		}
+	}
+}
+
+// forgetOrigins removes the origins of a key and everything below it.
+func forgetOrigins(origins map[string]string, p string) {
+	delete(origins, p)
+	for key := range origins {
+		if strings.HasPrefix(key, p+"/") {
+			delete(origins, key)
+		}
+	}
+}
+
+// render prints the tree produced by merging JSON files in order, a line per
+// leaf with the file it came from. The files are those given as arguments, or
+// else those given to -srcJSON.
+func render(args []string) {
+	files := splitFiles(args)
+	if len(files) == 0 {
+		files = splitFiles(srcJSON)
+	}
+	if len(files) == 0 {
+		usageErrorf("Usage: consul_loader render base.json overlay.json...")
+	}
+	secrets = loadSecretKey(keyFile, passphraseEnv)
+
+	values, origins := readJSONLayers(files)
+	if substitute || len(vars) > 0 || len(varFiles) > 0 {
+		values = substituteVariables(values, varFiles, vars)
+	}
+
+	// values that are secret, or encrypted in the files or on export, are
+	// masked, since encrypted values are shown decrypted
+	patterns := []string{}
+	for _, pattern := range encrypt {
+		patterns = append(patterns, normalizePattern(pattern))
+	}
+
+	// substitution may rename keys, so only the leaves still present are shown
+	leaves := values.flatten()
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for _, key := range sortedKeys(leaves) {
+		value := fmt.Sprint(leaves[key])
+		if isMasked(key) || matchAny(patterns, key) {
+			value = maskedValue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", key, value, origins[key])
+	}
+	w.Flush()
+}
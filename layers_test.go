@@ -0,0 +1,59 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestOverlay(t *testing.T) {
+	base := tree{
+		"app": map[string]interface{}{
+			"host":  "localhost",
+			"port":  "80",
+			"debug": "true",
+			"cache": map[string]interface{}{"size": "10"},
+		},
+	}
+	prod := tree{
+		"app": map[string]interface{}{
+			"host":  "db.prod",
+			"debug": map[string]interface{}{deleteTag: true},
+			"cache": map[string]interface{}{"size": map[string]interface{}{deleteTag: true}},
+			"tls":   map[string]interface{}{"enabled": "true"},
+		},
+	}
+
+	values := tree{}
+	origins := map[string]string{}
+	values.overlay(base, "base.json", "", origins)
+	values.overlay(prod, "prod.json", "", origins)
+
+	expected := map[string]interface{}{
+		"app/host":        "db.prod",
+		"app/port":        "80",
+		"app/tls/enabled": "true",
+	}
+	if leaves := values.flatten(); !reflect.DeepEqual(leaves, expected) {
+		t.Errorf("Expected %v, recieved: %v", expected, leaves)
+	}
+	if _, ok := values["app"].(map[string]interface{})["cache"]; ok {
+		t.Error("Expected the emptied folder to be removed")
+	}
+
+	expectedOrigins := map[string]string{
+		"app/host":        "prod.json",
+		"app/port":        "base.json",
+		"app/tls/enabled": "prod.json",
+	}
+	if !reflect.DeepEqual(origins, expectedOrigins) {
+		t.Errorf("Expected origins %v, recieved: %v", expectedOrigins, origins)
+	}
+}
+
+func TestSplitFiles(t *testing.T) {
+	files := splitFiles([]string{"base.json, prod.json", "prod-us-east.json"})
+	expected := []string{"base.json", "prod.json", "prod-us-east.json"}
+	if !reflect.DeepEqual(files, expected) {
+		t.Errorf("Expected %v, recieved: %v", expected, files)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// logFormat is the format of the lines logged: text or json.
+var logFormat string
+
+// destDatacenter is the datacenter of the destination profile.
+var destDatacenter string
+
+// errorClass is a kind of failure, each exiting with its own code.
+type errorClass string
+
+const (
+	classError      errorClass = "error"
+	classUsage      errorClass = "usage"
+	classConnection errorClass = "connection"
+	classACL        errorClass = "acl"
+	classValidation errorClass = "validation"
+	classConflict   errorClass = "conflict"
+	classDiff       errorClass = "diff"
+)
+
+// exitCodes are the exit codes of the kinds of failure. A run that succeeds
+// exits with 0.
+var exitCodes = map[errorClass]int{
+	classError:      1,
+	classUsage:      2,
+	classConnection: 3,
+	classACL:        4,
+	classValidation: 5,
+	classConflict:   6,
+	classDiff:       7,
+}
+
+// logFields are the structured fields of a line logged as JSON.
+type logFields struct {
+	Key        string     `json:"key,omitempty"`
+	Operation  string     `json:"operation,omitempty"`
+	Datacenter string     `json:"datacenter,omitempty"`
+	ErrorClass errorClass `json:"error_class,omitempty"`
+	Error      string     `json:"error,omitempty"`
+}
+
+// logLine is a line logged as JSON.
+type logLine struct {
+	Time    string `json:"time"`
+	Level   string `json:"level"`
+	Message string `json:"message"`
+	logFields
+}
+
+// setupLogging switches the log to the format given by -log-format.
+func setupLogging() {
+	switch logFormat {
+	case "text":
+	case "json":
+		log.SetFlags(0)
+		log.SetOutput(jsonLogWriter{os.Stderr})
+	default:
+		usageErrorf("Invalid log format, %s, expected text or json", logFormat)
+	}
+}
+
+// jsonLogWriter turns the lines of the standard logger into JSON lines.
+// Lines starting with "WARNING: " are logged as warnings.
+type jsonLogWriter struct {
+	w io.Writer
+}
+
+// Write logs a line written by the standard logger.
+func (w jsonLogWriter) Write(p []byte) (int, error) {
+	message, level := strings.TrimSuffix(string(p), "\n"), "info"
+	if strings.HasPrefix(message, "WARNING: ") {
+		message, level = strings.TrimPrefix(message, "WARNING: "), "warning"
+	}
+	return len(p), writeLogLine(w.w, level, message, logFields{})
+}
+
+// writeLogLine writes a line as a JSON object.
+func writeLogLine(w io.Writer, level, message string, fields logFields) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	return encoder.Encode(logLine{
+		Time:      time.Now().UTC().Format(time.RFC3339),
+		Level:     level,
+		Message:   message,
+		logFields: fields,
+	})
+}
+
+// logf logs a line about a key or operation. The fields are only written when
+// logging JSON.
+func logf(level string, fields logFields, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	if logFormat != "json" {
+		if level == "warning" {
+			message = "WARNING: " + message
+		}
+		log.Print(message)
+		return
+	}
+	writeLogLine(os.Stderr, level, message, fields)
+}
+
+// fatal logs an error of the class and exits with the class's code.
+func fatal(class errorClass, fields logFields, format string, args ...interface{}) {
+	fields.ErrorClass = class
+	logf("error", fields, format, args...)
+	os.Exit(exitCodes[class])
+}
+
+// fatalf logs an error and exits with the general failure code.
+func fatalf(format string, args ...interface{}) {
+	fatal(classError, logFields{}, format, args...)
+}
+
+// usageErrorf logs an error in the flags or arguments given and exits.
+func usageErrorf(format string, args ...interface{}) {
+	fatal(classUsage, logFields{}, format, args...)
+}
+
+// consulFailed logs an error returned by Consul for an operation on a key
+// and exits with the code of the kind of error: a connection failure, an ACL
+// denial or another error.
+func consulFailed(operation, key string, err error, format string, args ...interface{}) {
+	dc := destDatacenter
+	switch operation {
+	case "read", "list":
+		dc = source.Datacenter
+	}
+	fields := logFields{Key: key, Operation: operation, Datacenter: dc, Error: err.Error()}
+	fatal(classifyConsulError(err), fields, format, args...)
+}
+
+// consulError is an error returned by Consul for an operation on a key,
+// passed up to where the run fails.
+type consulError struct {
+	operation string
+	key       string
+	err       error
+}
+
+// Error describes the operation that failed.
+func (e *consulError) Error() string {
+	return fmt.Sprintf("failed to %s %s, %s", e.operation, e.key, e.err)
+}
+
+// classifyConsulError returns the kind of an error returned by the Consul API.
+func classifyConsulError(err error) errorClass {
+	switch err.(type) {
+	case *url.Error, net.Error:
+		return classConnection
+	}
+
+	message := err.Error()
+	switch {
+	case strings.Contains(message, "response code: 403"), strings.Contains(message, "response code: 401"),
+		strings.Contains(message, "Permission denied"), strings.Contains(message, "ACL not found"):
+		return classACL
+	}
+	return classError
+}
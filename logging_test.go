@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"testing"
+)
+
+func TestClassifyConsulError(t *testing.T) {
+	cases := []struct {
+		err      error
+		expected errorClass
+	}{
+		{&url.Error{Op: "Get", URL: "http://127.0.0.1:8500/v1/kv/app", Err: errors.New("connection refused")}, classConnection},
+		{errors.New("Unexpected response code: 403 (Permission denied)"), classACL},
+		{errors.New("Unexpected response code: 403"), classACL},
+		{errors.New("Unexpected response code: 500 (rpc error)"), classError},
+	}
+	for _, c := range cases {
+		if class := classifyConsulError(c.err); class != c.expected {
+			t.Errorf("Expected %s to be a %s error, recieved: %s", c.err, c.expected, class)
+		}
+	}
+}
+
+func TestJSONLogWriter(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := jsonLogWriter{buf}
+	w.Write([]byte("WARNING: folder keys are kept without their value, a/ => {x}\n"))
+
+	line := map[string]interface{}{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatal(err)
+	}
+	if line["level"] != "warning" || line["message"] != "folder keys are kept without their value, a/ => {x}" {
+		t.Errorf("Expected a warning, recieved: %v", line)
+	}
+	if _, ok := line["key"]; ok {
+		t.Errorf("Expected empty fields to be left out, recieved: %v", line)
+	}
+}
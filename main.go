@@ -3,138 +3,526 @@ package main
 import (
 	"encoding/json"
 	"flag"
-	"io/ioutil"
-	"log"
-	"os"
-	"path"
+	"strings"
 
 	consul "github.com/hashicorp/consul/api"
 )
 
 var (
-	kv       *consul.KV
-	srcKey   string
-	srcJSON  string
-	destKey  string
-	destJSON string
-	rename   bool
+	srcClient   *consul.Client
+	srcKV       *consul.KV
+	destKV      *consul.KV
+	srcKey      string
+	srcJSON     stringList
+	destKey     string
+	destJSON    string
+	srcDir      string
+	destDir     string
+	srcArchive  string
+	destArchive string
+	rename      bool
+	profileName string
+	srcProfile  string
+	destProfile string
+	profileFile string
+	consistency string
+	prefixMode  string
+	exportMeta  bool
+	include     stringList
+	exclude     stringList
+	rewrites    stringList
+	rewriteFile string
+	substitute  bool
+	vars        stringList
+	varFiles    stringList
+	encrypt     stringList
+	keyFile     string
+	newKeyFile  string
+	secrets     *secretKey
+	schemaFile  string
 )
 
-// init handles connecting to the Consul instance and reading in the flags.
-func init() {
-	// NOTE: this will utilize CONSUL_HTTP_ADDR if it is set.
-	client, err := consul.NewClient(consul.DefaultConfig())
-	if err != nil {
-		log.Fatalf("Failed to connect to Consul => {%s}", err)
-	}
-	kv = client.KV()
+// consulSource is set when -srcKey is given, even empty to read the whole
+// store.
+var consulSource bool
+
+// source describes where the values of a run were read from.
+var source struct {
+	Address    string
+	Datacenter string
+	Index      uint64
+}
+
+// stringList is a flag that may be given several times.
+type stringList []string
+
+// String returns the values of the flag separated by commas.
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
 
+// Set adds a value to the flag.
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// commands maps the name of a subcommand to the function that runs it. A
+// command is given as the first argument after the flags.
+var commands = map[string]func(args []string){
+	"backup":   backupPrefix,
+	"profiles": listProfiles,
+	"rekey":    rekey,
+	"render":   render,
+	"restore":  restoreBackup,
+	"show":     show,
+	"validate": validateFiles,
+}
+
+// init registers the flags.
+func init() {
 	flag.StringVar(&srcKey, "srcKey", "", "key to move values from")
 	flag.StringVar(&destKey, "destKey", "", "key to move values to")
-	flag.StringVar(&srcJSON, "srcJSON", "", "file to import values from")
+	flag.Var(&srcJSON, "srcJSON", "file to import values from, may be repeated or a comma separated list of files merged in order")
 	flag.StringVar(&destJSON, "destJSON", "", "file to export values to")
+	flag.StringVar(&srcDir, "srcDir", "", "directory of one file per key to import values from")
+	flag.StringVar(&destDir, "destDir", "", "directory to export values to, one file per key")
+	flag.StringVar(&srcArchive, "srcArchive", "", "tar.gz archive to import values from")
+	flag.StringVar(&destArchive, "destArchive", "", "tar.gz archive to export values to")
 	flag.BoolVar(&rename, "rename", false, "place as a rename instead of a insertion")
-	flag.Parse()
+	flag.StringVar(&profileName, "profile", "", "connection profile to use for both source and destination")
+	flag.StringVar(&srcProfile, "srcProfile", "", "connection profile to read values from")
+	flag.StringVar(&destProfile, "destProfile", "", "connection profile to write values to")
+	flag.StringVar(&profileFile, "profileFile", "", "file to load connection profiles from (default ~/.consul_loader.{json,yaml})")
+	flag.BoolVar(&exportMeta, "meta", false, "include key flags, indexes and sessions in exported values")
+	flag.Var(&include, "include", "glob pattern of keys to include, may be repeated")
+	flag.Var(&exclude, "exclude", "glob pattern of keys to exclude, may be repeated")
+	flag.Var(&rewrites, "rewrite", "rule rewriting keys, as pattern=>replacement or !pattern to drop keys, may be repeated")
+	flag.StringVar(&rewriteFile, "rewriteFile", "", "file of rewrite rules, one per line, applied before -rewrite rules")
+	flag.BoolVar(&substitute, "substitute", false, "replace ${VAR} placeholders in imported keys and values, implied by -var and -var-file")
+	flag.Var(&vars, "var", "variable for placeholders, as name=value, may be repeated")
+	flag.Var(&varFiles, "var-file", "JSON or YAML file of variables for placeholders, may be repeated")
+	flag.Var(&encrypt, "encrypt", "glob pattern of paths whose values are encrypted in exported files, may be repeated")
+	flag.StringVar(&keyFile, "keyFile", "", "file holding the key for encrypted values (default uses the passphrase in $"+passphraseEnv+")")
+	flag.StringVar(&newKeyFile, "newKeyFile", "", "file holding the key to rotate to with the rekey command (default uses $"+newPassphraseEnv+")")
+	flag.StringVar(&schemaFile, "schema", "", "JSON Schema file the values must satisfy before anything is written")
+	flag.StringVar(&onConflict, "on-conflict", "overwrite", "strategy for keys that already exist at the destination: overwrite, skip, fail or merge")
+	flag.StringVar(&fileMode, "mode", "0600", "octal permission mode of the files written")
+	flag.StringVar(&folderValue, "folderValue", "_value", "name of the child holding the value of a key that is also a folder")
+	flag.BoolVar(&chunkValues, "chunk", false, "store values over Consul's 512KB limit in chunks below their key")
+	flag.StringVar(&prefixMode, "prefixMode", "folder", "how -srcKey selects keys: folder (the key and its folder), exact (the key alone) or raw (every key starting with it)")
+	flag.BoolVar(&streaming, "stream", false, "stream exports from -srcKey to -destJSON and imports from -srcJSON to -destKey, holding few values in memory")
+	flag.StringVar(&reportFile, "report", "", "file to write the summary of the run to as JSON")
+	flag.StringVar(&logFormat, "log-format", "text", "format of the lines logged: text or json")
+	flag.StringVar(&consistency, "consistency", "", "consistency mode for reads: default, consistent or stale (overrides the profile)")
+}
+
+// countSet returns how many of the flag values are set.
+func countSet(values ...string) (count int) {
+	for _, v := range values {
+		if v != "" {
+			count++
+		}
+	}
+	return
+}
+
+// checkSource ensures exactly one source is given.
+func checkSource() {
+	count := countSet(srcJSON.String(), srcDir, srcArchive)
+	if consulSource {
+		count++
+	}
+	if count != 1 {
+		usageErrorf("Exactly one of the source key, JSON, directory or archive flags must utilized")
+	}
 }
 
 func normalizeArgs() {
-	if (srcKey != "" && srcJSON != "") || (srcKey == "" && srcJSON == "") {
-		log.Fatal("Either the source key or JSON flag must utilized")
-	} else if (destKey != "" && destJSON != "") || (destKey == "" && destJSON == "") {
-		log.Fatal("Either the destination key or JSON flag must utilized")
+	checkSource()
+	if countSet(destKey, destJSON, destDir, destArchive) != 1 {
+		usageErrorf("Exactly one of the destination key, JSON, directory or archive flags must utilized")
+	}
+
+	if srcDir == stdio || destDir == stdio {
+		usageErrorf("A directory cannot be read from stdin or written to stdout, use an archive instead")
+	}
+	stdin := 0
+	for _, filename := range append(splitFiles(srcJSON), srcArchive) {
+		if filename == stdio {
+			stdin++
+		}
+	}
+	if stdin > 1 {
+		usageErrorf("Only one source can be read from stdin")
+	}
+	if reportFile == stdio && (destJSON == stdio || destArchive == stdio) {
+		usageErrorf("The report and the export cannot both be written to stdout")
+	}
+
+	if len(vars) > 0 || len(varFiles) > 0 {
+		substitute = true
+	}
+	if substitute && consulSource {
+		usageErrorf("Variables can only be substituted when importing from a file")
 	}
 }
 
-// readJSONFile constructs a tree from a specifed JSON file. The function exits if the
-// file is not found.
+// checkConsistency ensures the consistency mode is one Consul understands.
+func checkConsistency() {
+	switch consistency {
+	case "", "default", "consistent", "stale":
+	default:
+		usageErrorf("Invalid consistency mode, %s, expected default, consistent or stale", consistency)
+	}
+}
+
+// readJSONFile constructs a tree from a specifed JSON file, or from stdin for
+// "-". The function exits if the file is not found.
 func readJSONFile(filename string) tree {
 	values := tree{}
 
 	// open and read file data
-	file, err := os.Open(filename)
+	file, err := openInput(filename)
 	if err != nil {
-		log.Printf("Failed to open srcJSON file => {%s}", err)
+		fatalf("Failed to open srcJSON file => {%s}", err)
 	}
+	defer file.Close()
 
 	// write data into tree
 	decoder := json.NewDecoder(file)
 	err = decoder.Decode(&values)
 	if err != nil {
-		log.Printf("Failed to decode json in file => {%s}", err)
+		fatal(classValidation, logFields{Operation: "read"}, "Failed to decode json in file, %s => {%s}", filename, err)
 	}
+	values.decodeEntries()
+	values.decrypt(secrets, "")
 
 	return values
 }
 
-// writeJSONFile writes retrieved data to a file.
+// writeJSONFile writes retrieved data to a file, or to stdout for "-".
 func writeJSONFile(t tree, filename string) {
 	// marshal data retrieved into JSON
 	data, err := json.Marshal(t)
 	if err != nil {
-		log.Fatalf("Error marshaling data for JSON => {%s}", err)
+		fatalf("Error marshaling data for JSON => {%s}", err)
 	}
 
 	// write data into file
-	err = ioutil.WriteFile(filename, data, os.ModePerm)
+	err = writeFileAtomic(filename, data, outputMode())
 	if err != nil {
-		log.Fatalf("Failed to write json data to file, %s => {%s}", destJSON, err)
+		fatalf("Failed to write json data to file, %s => {%s}", filename, err)
+	}
+}
+
+// encryptTree encrypts the values selected by the -encrypt patterns. The
+// function exits if values are selected but no key was given.
+func encryptTree(t tree) tree {
+	patterns := encryptPatterns()
+	if len(patterns) == 0 {
+		return t
+	}
+	return t.encrypt(secrets, patterns, "")
+}
+
+// encryptPatterns returns the -encrypt patterns, normalized. The function exits
+// if there are patterns but no key was given.
+func encryptPatterns() []string {
+	if len(encrypt) == 0 {
+		return nil
+	}
+	if secrets == nil {
+		usageErrorf("Encrypting values requires a key file or %s", passphraseEnv)
+	}
+
+	patterns := []string{}
+	for _, pattern := range encrypt {
+		patterns = append(patterns, normalizePattern(pattern))
 	}
+	return patterns
 }
 
-// readConsulTree constructs a tree from the Consul KV store at the specified key.
+// readConsulTree constructs a tree from the Consul KV store at the specified
+// key, read according to the prefix mode. An empty key reads the whole store.
 func readConsulTree(key string) tree {
 	values := tree{}
+	if prefixMode == "folder" {
+		key = strings.TrimSuffix(key, "/")
+	}
 
 	// try to find values in key given, else take all values
-	pairs, _, err := kv.List(srcKey, &consul.QueryOptions{})
+	pairs, meta, err := readPairs(key)
 	if err != nil {
-		log.Fatalf("Error retrieving data for specified key, %s => {%s}", srcKey, err)
-	} else if len(pairs) == 0 {
-		log.Fatalf("Failed to find any data, %s", srcKey)
+		consulFailed("read", key, err, "Error retrieving data for specified key, %s => {%s}", key, err)
+	}
+	if len(pairs) == 0 {
+		fatal(classError, logFields{Key: key, Operation: "read", Datacenter: source.Datacenter}, "Failed to find any data, %s", key)
 	}
+	reportStaleness(meta)
+	source.Index = meta.LastIndex
 
-	// determine how many characters from the start of the key to skip
-	base := path.Base(key)
-	skip := len(key) - len(base)
+	// the tree is rooted at the last segment of the key, so skip the
+	// segments before it
+	skip := strings.LastIndex(strings.TrimSuffix(key, "/"), "/") + 1
 
 	values.build(pairs, skip)
+	values.joinChunks("")
 
 	return values
 }
 
-// putConsulTree adds a config tree to a consul KV store at the specified key.
-func putConsulTree(t tree, key string) {
-	if !rename {
-		t.update("/" + key)
+// readPairs reads the pairs the prefix mode selects for a key. The exact mode
+// gets the key alone rather than listing everything below it.
+func readPairs(key string) (consul.KVPairs, *consul.QueryMeta, error) {
+	if prefixMode != "exact" {
+		pairs, meta, err := srcKV.List(key, queryOptions())
+		return matchPrefix(pairs, key), meta, err
+	}
+	if key == "" {
+		return nil, &consul.QueryMeta{}, nil
+	}
+
+	pair, meta, err := srcKV.Get(key, queryOptions())
+	if pair == nil {
+		return nil, meta, err
+	}
+	return consul.KVPairs{pair}, meta, err
+}
+
+// checkPrefixMode ensures the prefix mode is one that is understood.
+func checkPrefixMode() {
+	switch prefixMode {
+	case "folder", "exact", "raw":
+	default:
+		usageErrorf("Invalid prefix mode, %s, expected folder, exact or raw", prefixMode)
+	}
+}
+
+// matchPrefix keeps the pairs listed for a key that the prefix mode selects:
+// the key and its folder, the key alone, or every key starting with it.
+func matchPrefix(pairs consul.KVPairs, key string) consul.KVPairs {
+	if prefixMode == "raw" || key == "" && prefixMode == "folder" {
+		return pairs
+	}
+
+	matched := consul.KVPairs{}
+	for _, pair := range pairs {
+		switch {
+		case pair.Key == key:
+		case prefixMode == "folder" && strings.HasPrefix(pair.Key, key+"/"):
+		default:
+			continue
+		}
+		matched = append(matched, pair)
+	}
+	return matched
+}
+
+// queryOptions returns the options used when reading from the source cluster.
+func queryOptions() *consul.QueryOptions {
+	switch consistency {
+	case "consistent":
+		return &consul.QueryOptions{RequireConsistent: true}
+	case "stale":
+		return &consul.QueryOptions{AllowStale: true}
+	}
+	return &consul.QueryOptions{}
+}
+
+// reportStaleness logs how fresh the data returned by a stale read is, since
+// any server may have answered it.
+func reportStaleness(meta *consul.QueryMeta) {
+	if consistency != "stale" || meta == nil {
 		return
 	}
 
+	logf("info", logFields{Operation: "read", Datacenter: source.Datacenter}, "Stale read, last contact with the leader %s ago, known leader: %t", meta.LastContact, meta.KnownLeader)
+	if !meta.KnownLeader {
+		logf("warning", logFields{Operation: "read", Datacenter: source.Datacenter}, "the server answering the read does not know of a leader, data may be out of date")
+	}
+}
+
+// putConsulTree adds a config tree to a consul KV store at the specified key.
+// An empty key places the tree at the root of the store. Keys that already
+// exist are handled according to the conflict strategy.
+func putConsulTree(t tree, key string) {
+	targets := map[string]interface{}{}
 	for k, v := range t {
-		subTree, ok := v.(map[string]interface{})
-		if ok {
-			// push retrieved data to a Consul key
-			tree(subTree).update("/" + key)
-		} else {
-			push(key+"/"+k, v)
+		top := unescapeName(k)
+		if _, ok := v.(map[string]interface{}); !ok {
+			targets[targetKey(key, top, top, true)] = v
+			continue
 		}
+		for p, leaf := range (tree{k: v}).flatten() {
+			targets[targetKey(key, p, top, false)] = leaf
+		}
+	}
+
+	// skip the keys that cannot be written, and find what is already stored
+	// under the folders being written to
+	prefixes := []string{}
+	seen := map[string]bool{}
+	for _, k := range sortedKeys(targets) {
+		if !writableKey(k) {
+			delete(targets, k)
+			continue
+		}
+
+		prefix := key
+		if prefix == "" {
+			prefix = strings.SplitN(k, "/", 2)[0]
+		}
+		if !seen[prefix] {
+			seen[prefix] = true
+			prefixes = append(prefixes, prefix)
+		}
+	}
+
+	// values over the size limit are found before anything is written
+	checkValueSizes(targets)
+	if chunkValues {
+		targets = chunk(targets)
+	}
+
+	existing := existingKeys(prefixes)
+	stale := takeStale(targets, existing)
+	write, conflicts := resolveConflicts(onConflict, targets, existing)
+	if conflicts != nil {
+		refuseConflicts(conflicts)
+	}
+	deleteStale(stale)
+	progress := newProgress("Writing", len(write))
+	for _, k := range sortedKeys(write) {
+		push(k, write[k])
+		progress.add(len(resolveBytes(leafValue(write[k]))))
+	}
+	progress.done()
+}
+
+// targetKey returns the Consul key the leaf at path p of a tree is written to
+// below the key. The top level name of the path is given, and whether the
+// leaf is a top level value. When renaming, the top level folders of the tree
+// take the place of the key, the folder's own value going to the key itself.
+func targetKey(key, p, top string, topLeaf bool) string {
+	switch {
+	case key == "" && !rename:
+		return p
+	case !rename || topLeaf:
+		return key + "/" + p
+	}
+	return key + strings.TrimPrefix(p, top)
+}
+
+// writableKey reports whether a key is written. Keys with empty segments are
+// skipped with a warning. The function exits if a key uses the name reserved
+// for chunk folders.
+func writableKey(k string) bool {
+	if hasChunkSegment(k) {
+		fatal(classValidation, logFields{Key: k, Operation: "write"}, "%s is reserved for values stored in chunks, cannot write %s", chunkFolder, k)
+	}
+	if strings.HasPrefix(k, "/") || strings.Contains(k, "//") {
+		// the HTTP API cleans such paths before they reach the KV store
+		logf("warning", logFields{Key: k, Operation: "write"}, "keys with empty segments cannot be written through the HTTP API, skipped %s", k)
+		return false
+	}
+	return true
+}
+
+// readSource reads the values from the source given by the flags.
+func readSource() tree {
+	switch {
+	case len(srcJSON) > 0:
+		values, _ := readJSONLayers(splitFiles(srcJSON))
+		return values
+	case srcDir != "":
+		return readDirTree(srcDir)
+	case srcArchive != "":
+		return readArchive(srcArchive)
 	}
+	return readConsulTree(srcKey)
 }
 
 func main() {
+	flag.Parse()
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "srcKey" {
+			consulSource = true
+		}
+	})
+	setupLogging()
+	if flag.NArg() > 0 {
+		run, ok := commands[flag.Arg(0)]
+		if !ok {
+			usageErrorf("Unknown command, %s", flag.Arg(0))
+		}
+		run(flag.Args()[1:])
+		return
+	}
+
 	values := tree{}
 	normalizeArgs()
+	connect()
+	secrets = loadSecretKey(keyFile, passphraseEnv)
+	checkConsistency()
+	checkOnConflict()
+	checkPrefixMode()
 
-	// 1. find the input data from either a file or Consul key
-	if srcJSON != "" {
-		values = readJSONFile(srcJSON)
+	// filter the keys as they leave the source, by their paths in a file
+	if !consulSource {
+		importFilter = newKeyFilter(include, exclude)
 	} else {
-		values = readConsulTree(srcKey)
+		exportFilter = newKeyFilter(include, exclude)
+	}
+	rules := readRewriteRules(rewriteFile, rewrites)
+
+	// large transfers are written as they are read rather than held in memory
+	if streaming {
+		checkStream()
+		if consulSource {
+			streamConsulTree(srcKey, destJSON)
+		} else {
+			streamJSONToConsul(srcJSON.String(), destKey)
+		}
+		return
+	}
+
+	// 1. find the input data from either a file, a directory, an archive or Consul key
+	values = readSource()
+	summary.Read, _ = values.stats()
+	values = values.filter(importFilter)
+	if substitute {
+		values = substituteVariables(values, varFiles, vars)
+	}
+
+	// rewrite the keys on their way to the destination
+	if len(rules) > 0 {
+		values = values.rewrite(rules)
+	}
+
+	// values read from Consul are all strings, so validate them leniently
+	if schemaFile != "" {
+		checkSchema(schemaFile, values, len(srcJSON) == 0)
 	}
 
 	// 2. write the src data to the destination
-	if destJSON != "" {
+	switch {
+	case destJSON != "":
+		values = encryptTree(mergeFile(values, destJSON, readJSONFile))
 		writeJSONFile(values, destJSON)
-	} else {
+	case destDir != "":
+		values = encryptTree(mergeFile(values, destDir, readDirTree))
+		writeDirTree(values, destDir)
+	case destArchive != "":
+		values = encryptTree(mergeFile(values, destArchive, readArchive))
+		writeArchive(values, destArchive)
+	default:
 		putConsulTree(values, destKey)
 	}
+	// values pushed to Consul are counted as they are written
+	if destKey == "" {
+		_, summary.Bytes = values.stats()
+	}
+
+	summary.report()
 }
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+func TestMatchPrefix(t *testing.T) {
+	defer func() { prefixMode = "folder" }()
+
+	pairs := consul.KVPairs{}
+	for _, key := range []string{"app", "app/db", "app/db/host", "app-legacy/x", "apple/y"} {
+		pairs = append(pairs, &consul.KVPair{Key: key})
+	}
+
+	cases := []struct {
+		mode, key string
+		expected  []string
+	}{
+		{"folder", "app", []string{"app", "app/db", "app/db/host"}},
+		{"folder", "", []string{"app", "app/db", "app/db/host", "app-legacy/x", "apple/y"}},
+		{"exact", "app/db", []string{"app/db"}},
+		{"raw", "app", []string{"app", "app/db", "app/db/host", "app-legacy/x", "apple/y"}},
+	}
+	for _, c := range cases {
+		prefixMode = c.mode
+		matched := matchPrefix(pairs, c.key)
+		if len(matched) != len(c.expected) {
+			t.Errorf("Expected %v in %s mode, recieved %d keys", c.expected, c.mode, len(matched))
+			continue
+		}
+		for i, pair := range matched {
+			if pair.Key != c.expected[i] {
+				t.Errorf("Expected %v in %s mode, recieved %s at %d", c.expected, c.mode, pair.Key, i)
+			}
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	consul "github.com/hashicorp/consul/api"
+	"gopkg.in/yaml.v2"
+)
+
+// profileFiles are the names, relative to the home directory, searched for
+// connection profiles. The first file that exists is used.
+var profileFiles = []string{".consul_loader.json", ".consul_loader.yaml", ".consul_loader.yml"}
+
+// profile describes how to connect to a single Consul cluster.
+type profile struct {
+	Address     string     `json:"address" yaml:"address"`
+	Scheme      string     `json:"scheme" yaml:"scheme"`
+	Datacenter  string     `json:"datacenter" yaml:"datacenter"`
+	TokenFile   string     `json:"token_file" yaml:"token_file"`
+	TLS         tlsProfile `json:"tls" yaml:"tls"`
+	Consistency string     `json:"consistency" yaml:"consistency"`
+}
+
+// tlsProfile holds the TLS settings of a profile.
+type tlsProfile struct {
+	CAFile             string `json:"ca_file" yaml:"ca_file"`
+	CertFile           string `json:"cert_file" yaml:"cert_file"`
+	KeyFile            string `json:"key_file" yaml:"key_file"`
+	ServerName         string `json:"server_name" yaml:"server_name"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify" yaml:"insecure_skip_verify"`
+}
+
+// profileConfig is the layout of the profile file.
+type profileConfig struct {
+	Profiles map[string]profile `json:"profiles" yaml:"profiles"`
+}
+
+// findProfileFile returns the path of the profile file to use, or an empty
+// string if there is none.
+func findProfileFile() string {
+	if profileFile != "" {
+		return profileFile
+	}
+
+	home := os.Getenv("HOME")
+	for _, name := range profileFiles {
+		filename := filepath.Join(home, name)
+		if _, err := os.Stat(filename); err == nil {
+			return filename
+		}
+	}
+	return ""
+}
+
+// readProfiles loads the profiles defined in the profile file. The function
+// exits if the file cannot be read or decoded.
+func readProfiles() map[string]profile {
+	filename := findProfileFile()
+	if filename == "" {
+		usageErrorf("Failed to find a profile file, expected one of ~/%s", strings.Join(profileFiles, ", ~/"))
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		fatalf("Failed to read profile file, %s => {%s}", filename, err)
+	}
+
+	config := profileConfig{}
+	switch path.Ext(filename) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &config)
+	default:
+		err = json.Unmarshal(data, &config)
+	}
+	if err != nil {
+		fatalf("Failed to decode profile file, %s => {%s}", filename, err)
+	}
+
+	return config.Profiles
+}
+
+// lookupProfile returns the named profile. The function exits if it is not defined.
+func lookupProfile(name string) profile {
+	p, ok := readProfiles()[name]
+	if !ok {
+		usageErrorf("Profile is not defined, %s", name)
+	}
+	return p
+}
+
+// config translates a profile into the configuration for a Consul client.
+func (p profile) config() (*consul.Config, error) {
+	config := consul.DefaultConfig()
+	if p.Address != "" {
+		config.Address = p.Address
+	}
+	if p.Scheme != "" {
+		config.Scheme = p.Scheme
+	}
+	config.Datacenter = p.Datacenter
+
+	if p.TokenFile != "" {
+		token, err := ioutil.ReadFile(p.TokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read token file, %s => {%s}", p.TokenFile, err)
+		}
+		config.Token = strings.TrimSpace(string(token))
+	}
+
+	if p.TLS != (tlsProfile{}) {
+		tlsConfig, err := p.TLS.config()
+		if err != nil {
+			return nil, err
+		}
+		config.HttpClient = &http.Client{
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		}
+		if p.Scheme == "" {
+			config.Scheme = "https"
+		}
+	}
+
+	return config, nil
+}
+
+// config builds the TLS configuration described by the profile.
+func (t tlsProfile) config() (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         t.ServerName,
+		InsecureSkipVerify: t.InsecureSkipVerify,
+	}
+
+	if t.CAFile != "" {
+		pem, err := ioutil.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file, %s => {%s}", t.CAFile, err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("failed to parse CA file, %s", t.CAFile)
+		}
+	}
+
+	if t.CertFile != "" || t.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate => {%s}", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// newClient creates a Consul client from the named profile. With no profile
+// the default configuration is used, which honors CONSUL_HTTP_ADDR.
+func newClient(name string) (*consul.Client, profile, *consul.Config) {
+	p := profile{}
+	if name != "" {
+		p = lookupProfile(name)
+	}
+
+	config, err := p.config()
+	if err != nil {
+		usageErrorf("Invalid profile, %s => {%s}", name, err)
+	}
+
+	client, err := consul.NewClient(config)
+	if err != nil {
+		fatal(classConnection, logFields{Error: err.Error()}, "Failed to connect to Consul => {%s}", err)
+	}
+	return client, p, config
+}
+
+// connect creates the Consul clients used for reading and writing. The source
+// and destination profiles fall back to the shared profile flag.
+func connect() {
+	if srcProfile == "" {
+		srcProfile = profileName
+	}
+	if destProfile == "" {
+		destProfile = profileName
+	}
+
+	client, p, config := newClient(srcProfile)
+	srcClient = client
+	srcKV = client.KV()
+	source.Address = config.Scheme + "://" + config.Address
+	source.Datacenter = p.Datacenter
+	if consistency == "" {
+		consistency = p.Consistency
+	}
+
+	client, p, _ = newClient(destProfile)
+	destKV = client.KV()
+	destDatacenter = p.Datacenter
+}
+
+// listProfiles prints every defined profile along with the current leader of
+// its cluster, or the error encountered while contacting it.
+func listProfiles(args []string) {
+	profiles := readProfiles()
+
+	names := []string{}
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		p := profiles[name]
+		address := p.Address
+		status := ""
+
+		config, err := p.config()
+		if err == nil {
+			var client *consul.Client
+			client, err = consul.NewClient(config)
+			address = config.Scheme + "://" + config.Address
+			if err == nil {
+				status, err = client.Status().Leader()
+			}
+		}
+
+		if err != nil {
+			status = fmt.Sprintf("unreachable => {%s}", err)
+		} else if status == "" {
+			status = "no leader"
+		} else {
+			status = "leader " + status
+		}
+		fmt.Printf("%s\t%s\t%s\t%s\n", name, address, p.Datacenter, status)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+const (
+	// progressLogInterval is how often progress is logged when stderr is not
+	// a terminal.
+	progressLogInterval = 5 * time.Second
+	// progressDrawInterval is how often progress is redrawn on a terminal.
+	progressDrawInterval = 100 * time.Millisecond
+)
+
+// activeProgress is the progress being shown, ended when the run is summarized.
+var activeProgress *progress
+
+// progress shows how many keys of a run are done, with their rate and the
+// time left when the total is known. On a terminal the line on stderr is
+// redrawn in place, otherwise it is logged from time to time.
+type progress struct {
+	verb    string
+	total   int
+	keys    int
+	bytes   int
+	tty     bool
+	started time.Time
+	shown   time.Time
+}
+
+// newProgress starts showing the progress of the keys described by the verb.
+// A total of 0 means the number of keys is not known.
+func newProgress(verb string, total int) *progress {
+	now := time.Now()
+	p := &progress{verb: verb, total: total, tty: isTerminal(os.Stderr) && logFormat != "json", started: now, shown: now}
+	activeProgress = p
+	return p
+}
+
+// isTerminal reports whether the file is a terminal.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// add counts a key done, with the size of its value.
+func (p *progress) add(size int) {
+	p.keys++
+	p.bytes += size
+
+	interval := progressLogInterval
+	if p.tty {
+		interval = progressDrawInterval
+	}
+	if time.Since(p.shown) >= interval {
+		p.show()
+	}
+}
+
+// show writes the progress line.
+func (p *progress) show() {
+	p.shown = time.Now()
+	if p.tty {
+		fmt.Fprintf(os.Stderr, "\r%s\033[K", p.line(p.shown))
+	} else {
+		logf("info", logFields{}, "%s", p.line(p.shown))
+	}
+}
+
+// line describes the progress at the time.
+func (p *progress) line(now time.Time) string {
+	rate := 0.0
+	if elapsed := now.Sub(p.started).Seconds(); elapsed > 0 {
+		rate = float64(p.keys) / elapsed
+	}
+	if p.total == 0 {
+		return fmt.Sprintf("%s %d keys, %s, %.0f keys/s", p.verb, p.keys, formatBytes(p.bytes), rate)
+	}
+
+	line := fmt.Sprintf("%s %d/%d keys (%d%%), %s, %.0f keys/s", p.verb, p.keys, p.total, p.keys*100/p.total, formatBytes(p.bytes), rate)
+	if rate > 0 && p.keys < p.total {
+		left := time.Duration(float64(p.total-p.keys)/rate) * time.Second
+		line += fmt.Sprintf(", ETA %s", left)
+	}
+	return line
+}
+
+// done ends the progress, leaving its final line on a terminal.
+func (p *progress) done() {
+	if p == nil || activeProgress != p {
+		return
+	}
+	activeProgress = nil
+	if p.tty && p.keys > 0 {
+		p.show()
+		fmt.Fprintln(os.Stderr)
+	}
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProgressLine(t *testing.T) {
+	started := time.Now()
+	p := &progress{verb: "Writing", total: 100, keys: 25, bytes: 2048, started: started}
+
+	expected := "Writing 25/100 keys (25%), 2.0 KB, 5 keys/s, ETA 15s"
+	if line := p.line(started.Add(5 * time.Second)); line != expected {
+		t.Errorf("Expected: %s\nRecieved: %s", expected, line)
+	}
+
+	p.total = 0
+	expected = "Writing 25 keys, 2.0 KB, 5 keys/s"
+	if line := p.line(started.Add(5 * time.Second)); line != expected {
+		t.Errorf("Expected: %s\nRecieved: %s", expected, line)
+	}
+}
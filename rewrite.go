@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// rewriteSeparator separates the pattern of a rewrite rule from its replacement.
+const rewriteSeparator = "=>"
+
+// rewriteRule rewrites the keys matching a regular expression. A rule that
+// drops keys removes every key it matches instead.
+type rewriteRule struct {
+	pattern     *regexp.Regexp
+	replacement string
+	drop        bool
+}
+
+// parseRewriteRule reads a rule written as "pattern=>replacement", or as
+// "!pattern" to drop the matching keys. The replacement may refer to groups
+// of the pattern as $1 or ${name}. The function exits if the rule is malformed.
+func parseRewriteRule(rule string) rewriteRule {
+	if strings.HasPrefix(rule, "!") {
+		return rewriteRule{pattern: compileRewritePattern(rule[1:]), drop: true}
+	}
+
+	parts := strings.SplitN(rule, rewriteSeparator, 2)
+	if len(parts) != 2 {
+		usageErrorf("Invalid rewrite rule, %s, expected pattern%sreplacement or !pattern", rule, rewriteSeparator)
+	}
+	return rewriteRule{
+		pattern:     compileRewritePattern(strings.TrimSpace(parts[0])),
+		replacement: strings.TrimSpace(parts[1]),
+	}
+}
+
+// compileRewritePattern compiles the regular expression of a rule.
+func compileRewritePattern(pattern string) *regexp.Regexp {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		usageErrorf("Invalid rewrite pattern, %s => {%s}", pattern, err)
+	}
+	return re
+}
+
+// readRewriteRules builds the ordered rule list, taking the rules in the rules
+// file first and the rules given as flags after them.
+func readRewriteRules(filename string, rules []string) []rewriteRule {
+	lines := []string{}
+	if filename != "" {
+		file, err := os.Open(filename)
+		if err != nil {
+			fatalf("Failed to open rewrite rules file, %s => {%s}", filename, err)
+		}
+		defer file.Close()
+
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			lines = append(lines, line)
+		}
+		if err := scanner.Err(); err != nil {
+			fatalf("Failed to read rewrite rules file, %s => {%s}", filename, err)
+		}
+	}
+
+	parsed := []rewriteRule{}
+	for _, rule := range append(lines, rules...) {
+		parsed = append(parsed, parseRewriteRule(rule))
+	}
+	return parsed
+}
+
+// rewriteKey applies every rule in order, each to the result of the one
+// before it. It returns false if a rule drops the key.
+func rewriteKey(rules []rewriteRule, key string) (string, bool) {
+	for _, rule := range rules {
+		if !rule.pattern.MatchString(key) {
+			continue
+		}
+		if rule.drop {
+			return "", false
+		}
+		key = rule.pattern.ReplaceAllString(key, rule.replacement)
+	}
+	return key, true
+}
+
+// rewrite returns a copy of the tree with the rules applied to the path of
+// every leaf. Dropped keys and keys that collide with another rewritten key
+// are recorded in the run summary; on a collision the key that sorts last wins.
+func (t tree) rewrite(rules []rewriteRule) tree {
+	leaves := t.flatten()
+	keys := []string{}
+	for key := range leaves {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	rewritten := tree{}
+	sources := map[string]string{}
+	for _, key := range keys {
+		newKey, ok := rewriteKey(rules, key)
+		if !ok {
+			summary.Dropped.add(key)
+			continue
+		}
+
+		if source, exists := sources[newKey]; exists {
+			summary.Collisions.add(source + ", " + key + " => " + newKey)
+		}
+		sources[newKey] = key
+		rewritten.add(newKey, leaves[key])
+	}
+
+	return rewritten
+}
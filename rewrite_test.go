@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestRewrite(t *testing.T) {
+	defer func() { summary = runSummary{} }()
+
+	rules := readRewriteRules("", []string{
+		`^services/foo-staging/=>services/foo/`,
+		`!/tmp/`,
+		`^dc1/(.*)$=>dc2/$1`,
+		`^services/bar-staging/=>services/foo/`,
+	})
+	values := tree{
+		"services": map[string]interface{}{
+			"foo-staging": map[string]interface{}{"host": "a", "tmp": map[string]interface{}{"x": "1"}},
+			"bar-staging": map[string]interface{}{"host": "b"},
+		},
+		"dc1": map[string]interface{}{"port": "1"},
+	}
+
+	leaves := values.rewrite(rules).flatten()
+	if len(leaves) != 2 || leaves["services/foo/host"] != "a" || leaves["dc2/port"] != "1" {
+		t.Errorf("Unexpected rewritten keys: %v", leaves)
+	}
+	if summary.Dropped.count != 1 || summary.Dropped.sample[0] != "services/foo-staging/tmp/x" {
+		t.Errorf("Expected the tmp key to be dropped, recieved: %v", summary.Dropped)
+	}
+	if summary.Collisions.count != 1 {
+		t.Errorf("Expected one collision, recieved: %v", summary.Collisions)
+	}
+}
@@ -0,0 +1,477 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// validator checks a tree against a JSON Schema, collecting every violation.
+// It supports the commonly used keywords: type, enum, const, properties,
+// required, additionalProperties, patternProperties, min/maxProperties,
+// items, min/maxItems, minimum, maximum, the exclusive bounds, multipleOf,
+// min/maxLength, pattern, allOf, anyOf, oneOf, not and local $ref.
+//
+// Values read from Consul are always strings, so a lenient validator accepts
+// a string wherever its text is a valid number or boolean.
+type validator struct {
+	root       map[string]interface{}
+	lenient    bool
+	violations []string
+	// resolving holds the references being followed at each path, so a
+	// reference that leads back to itself is reported instead of followed
+	resolving map[string]bool
+}
+
+// readSchema loads a JSON Schema from a file. The function exits if the file
+// cannot be read or decoded.
+func readSchema(filename string) map[string]interface{} {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		fatalf("Failed to read schema file, %s => {%s}", filename, err)
+	}
+
+	schema := map[string]interface{}{}
+	if err := json.Unmarshal(data, &schema); err != nil {
+		fatalf("Failed to decode schema file, %s => {%s}", filename, err)
+	}
+	return schema
+}
+
+// validateTree returns every violation of the schema found in the tree.
+func validateTree(schema map[string]interface{}, t tree, lenient bool) []string {
+	v := &validator{root: schema, lenient: lenient, resolving: map[string]bool{}}
+	v.validate(schema, map[string]interface{}(t), "")
+	sort.Strings(v.violations)
+	return v.violations
+}
+
+// checkSchema validates the tree against the schema file and exits, listing
+// every violation, if there are any.
+func checkSchema(filename string, t tree, lenient bool) {
+	violations := validateTree(readSchema(filename), t, lenient)
+	if len(violations) == 0 {
+		return
+	}
+
+	for _, violation := range violations {
+		logf("error", logFields{Operation: "validate", ErrorClass: classValidation}, "%s", violation)
+	}
+	fatal(classValidation, logFields{}, "Found %d schema violations, nothing was written", len(violations))
+}
+
+// validateFiles checks JSON files against the schema without connecting to Consul.
+func validateFiles(args []string) {
+	if schemaFile == "" || len(args) == 0 {
+		usageErrorf("Usage: consul_loader -schema schema.json validate file.json...")
+	}
+	secrets = loadSecretKey(keyFile, passphraseEnv)
+	schema := readSchema(schemaFile)
+
+	failed := false
+	for _, filename := range args {
+		values := readJSONFile(filename)
+		if substitute || len(vars) > 0 || len(varFiles) > 0 {
+			values = substituteVariables(values, varFiles, vars)
+		}
+
+		violations := validateTree(schema, values, false)
+		for _, violation := range violations {
+			logf("error", logFields{Operation: "validate", ErrorClass: classValidation}, "%s: %s", filename, violation)
+		}
+		if len(violations) > 0 {
+			failed = true
+		} else {
+			logf("info", logFields{Operation: "validate"}, "%s: valid", filename)
+		}
+	}
+
+	if failed {
+		fatal(classValidation, logFields{}, "Validation failed")
+	}
+}
+
+// fail records a violation at the path.
+func (v *validator) fail(p string, format string, args ...interface{}) {
+	if p == "" {
+		p = "/"
+	}
+	v.violations = append(v.violations, p+": "+fmt.Sprintf(format, args...))
+}
+
+// check validates a value against a subschema without recording violations,
+// reporting whether it is valid.
+func (v *validator) check(s interface{}, value interface{}, p string) bool {
+	sub := &validator{root: v.root, lenient: v.lenient, resolving: v.resolving}
+	sub.validate(s, value, p)
+	return len(sub.violations) == 0
+}
+
+// validate checks a value, found at the path, against a schema.
+func (v *validator) validate(s interface{}, value interface{}, p string) {
+	if b, ok := s.(bool); ok {
+		if !b {
+			v.fail(p, "no value is allowed")
+		}
+		return
+	}
+	schema, ok := s.(map[string]interface{})
+	if !ok {
+		return
+	}
+
+	if e, ok := value.(entry); ok {
+		value = e.Value
+	}
+
+	if ref, ok := schema["$ref"].(string); ok {
+		target, err := v.resolveRef(ref)
+		if err != nil {
+			v.fail(p, "%s", err)
+			return
+		}
+
+		// a reference met again at the same path never reaches a value
+		following := ref + " at " + p
+		if v.resolving[following] {
+			v.fail(p, "invalid schema, circular reference, %s", ref)
+			return
+		}
+		v.resolving[following] = true
+		v.validate(target, value, p)
+		delete(v.resolving, following)
+	}
+
+	if !v.validateType(schema, value, p) {
+		return
+	}
+
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, option := range enum {
+			if v.equal(option, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			v.fail(p, "value %v is not one of %v", value, enum)
+		}
+	}
+	if constant, ok := schema["const"]; ok && !v.equal(constant, value) {
+		v.fail(p, "value %v is not %v", value, constant)
+	}
+
+	switch val := value.(type) {
+	case map[string]interface{}:
+		v.validateObject(schema, val, p)
+	case tree:
+		v.validateObject(schema, val, p)
+	case []interface{}:
+		v.validateArray(schema, val, p)
+	case string:
+		v.validateString(schema, val, p)
+	case binaryValue:
+		v.validateString(schema, string(val), p)
+	}
+	if n, ok := v.number(value); ok {
+		v.validateNumber(schema, n, p)
+	}
+
+	v.validateCombinators(schema, value, p)
+}
+
+// resolveRef finds the subschema a local reference such as
+// "#/definitions/port" points to.
+func (v *validator) resolveRef(ref string) (interface{}, error) {
+	if !strings.HasPrefix(ref, "#") {
+		return nil, fmt.Errorf("only local references are supported, %s", ref)
+	}
+
+	var node interface{} = v.root
+	for _, part := range strings.Split(strings.TrimPrefix(ref[1:], "/"), "/") {
+		if part == "" {
+			continue
+		}
+		part = strings.Replace(strings.Replace(part, "~1", "/", -1), "~0", "~", -1)
+		object, ok := node.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("unresolved reference, %s", ref)
+		}
+		if node, ok = object[part]; !ok {
+			return nil, fmt.Errorf("unresolved reference, %s", ref)
+		}
+	}
+	return node, nil
+}
+
+// validateType checks the type keyword, reporting whether the value matched.
+func (v *validator) validateType(schema map[string]interface{}, value interface{}, p string) bool {
+	types := []string{}
+	switch t := schema["type"].(type) {
+	case string:
+		types = append(types, t)
+	case []interface{}:
+		for _, name := range t {
+			if s, ok := name.(string); ok {
+				types = append(types, s)
+			}
+		}
+	default:
+		return true
+	}
+
+	for _, t := range types {
+		if v.isType(t, value) {
+			return true
+		}
+	}
+	v.fail(p, "expected %s, got %s", strings.Join(types, " or "), typeName(value))
+	return false
+}
+
+// isType reports whether the value is of the named JSON type.
+func (v *validator) isType(t string, value interface{}) bool {
+	switch t {
+	case "object":
+		switch value.(type) {
+		case map[string]interface{}, tree:
+			return true
+		}
+	case "array":
+		_, ok := value.([]interface{})
+		return ok
+	case "string":
+		switch value.(type) {
+		case string, binaryValue:
+			return true
+		}
+	case "number":
+		_, ok := v.number(value)
+		return ok
+	case "integer":
+		n, ok := v.number(value)
+		return ok && n == math.Trunc(n)
+	case "boolean":
+		if _, ok := value.(bool); ok {
+			return true
+		}
+		s, ok := value.(string)
+		return ok && v.lenient && (s == "true" || s == "false")
+	case "null":
+		return value == nil
+	}
+	return false
+}
+
+// typeName returns the JSON type of a value.
+func typeName(value interface{}) string {
+	switch value.(type) {
+	case map[string]interface{}, tree:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string, binaryValue:
+		return "string"
+	case float64, int, int64:
+		return "number"
+	case bool:
+		return "boolean"
+	case nil:
+		return "null"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+// number returns the numeric value of a value, if it has one.
+func (v *validator) number(value interface{}) (float64, bool) {
+	switch val := value.(type) {
+	case float64:
+		return val, true
+	case int:
+		return float64(val), true
+	case int64:
+		return float64(val), true
+	case string:
+		if v.lenient {
+			n, err := strconv.ParseFloat(val, 64)
+			return n, err == nil
+		}
+	}
+	return 0, false
+}
+
+// equal compares a value from the schema with a value from the tree.
+func (v *validator) equal(expected, value interface{}) bool {
+	if t, ok := value.(tree); ok {
+		value = map[string]interface{}(t)
+	}
+	if reflect.DeepEqual(expected, value) {
+		return true
+	}
+
+	s, ok := value.(string)
+	return ok && v.lenient && fmt.Sprint(expected) == s
+}
+
+// validateObject checks the keywords that apply to objects.
+func (v *validator) validateObject(schema map[string]interface{}, object map[string]interface{}, p string) {
+	if required, ok := schema["required"].([]interface{}); ok {
+		for _, name := range required {
+			if key, ok := name.(string); ok {
+				if _, exists := object[key]; !exists {
+					v.fail(p, "missing required key %s", key)
+				}
+			}
+		}
+	}
+
+	if n, ok := schema["minProperties"].(float64); ok && float64(len(object)) < n {
+		v.fail(p, "expected at least %v keys, got %d", n, len(object))
+	}
+	if n, ok := schema["maxProperties"].(float64); ok && float64(len(object)) > n {
+		v.fail(p, "expected at most %v keys, got %d", n, len(object))
+	}
+
+	properties, _ := schema["properties"].(map[string]interface{})
+	patterns, _ := schema["patternProperties"].(map[string]interface{})
+	additional, hasAdditional := schema["additionalProperties"]
+
+	for key, value := range object {
+		child := p + "/" + key
+		matched := false
+
+		if s, ok := properties[key]; ok {
+			matched = true
+			v.validate(s, value, child)
+		}
+		for pattern, s := range patterns {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				v.fail(p, "invalid pattern %s => {%s}", pattern, err)
+				continue
+			}
+			if re.MatchString(key) {
+				matched = true
+				v.validate(s, value, child)
+			}
+		}
+
+		if !matched && hasAdditional {
+			if allowed, ok := additional.(bool); ok && !allowed {
+				v.fail(child, "key is not allowed")
+			} else {
+				v.validate(additional, value, child)
+			}
+		}
+	}
+}
+
+// validateArray checks the keywords that apply to arrays.
+func (v *validator) validateArray(schema map[string]interface{}, array []interface{}, p string) {
+	if n, ok := schema["minItems"].(float64); ok && float64(len(array)) < n {
+		v.fail(p, "expected at least %v items, got %d", n, len(array))
+	}
+	if n, ok := schema["maxItems"].(float64); ok && float64(len(array)) > n {
+		v.fail(p, "expected at most %v items, got %d", n, len(array))
+	}
+
+	switch items := schema["items"].(type) {
+	case map[string]interface{}, bool:
+		for i, value := range array {
+			v.validate(items, value, fmt.Sprintf("%s/%d", p, i))
+		}
+	case []interface{}:
+		for i, value := range array {
+			if i < len(items) {
+				v.validate(items[i], value, fmt.Sprintf("%s/%d", p, i))
+			}
+		}
+	}
+}
+
+// validateString checks the keywords that apply to strings.
+func (v *validator) validateString(schema map[string]interface{}, s string, p string) {
+	length := utf8.RuneCountInString(s)
+	if n, ok := schema["minLength"].(float64); ok && float64(length) < n {
+		v.fail(p, "expected at least %v characters, got %d", n, length)
+	}
+	if n, ok := schema["maxLength"].(float64); ok && float64(length) > n {
+		v.fail(p, "expected at most %v characters, got %d", n, length)
+	}
+
+	if pattern, ok := schema["pattern"].(string); ok {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			v.fail(p, "invalid pattern %s => {%s}", pattern, err)
+		} else if !re.MatchString(s) {
+			v.fail(p, "value %q does not match %s", s, pattern)
+		}
+	}
+}
+
+// validateNumber checks the keywords that apply to numbers.
+func (v *validator) validateNumber(schema map[string]interface{}, n float64, p string) {
+	if min, ok := schema["minimum"].(float64); ok && n < min {
+		v.fail(p, "value %v is less than %v", n, min)
+	}
+	if max, ok := schema["maximum"].(float64); ok && n > max {
+		v.fail(p, "value %v is greater than %v", n, max)
+	}
+	if min, ok := schema["exclusiveMinimum"].(float64); ok && n <= min {
+		v.fail(p, "value %v is not greater than %v", n, min)
+	}
+	if max, ok := schema["exclusiveMaximum"].(float64); ok && n >= max {
+		v.fail(p, "value %v is not less than %v", n, max)
+	}
+	if m, ok := schema["multipleOf"].(float64); ok && m > 0 {
+		if q := n / m; q != math.Trunc(q) {
+			v.fail(p, "value %v is not a multiple of %v", n, m)
+		}
+	}
+}
+
+// validateCombinators checks allOf, anyOf, oneOf and not.
+func (v *validator) validateCombinators(schema map[string]interface{}, value interface{}, p string) {
+	if allOf, ok := schema["allOf"].([]interface{}); ok {
+		for _, s := range allOf {
+			v.validate(s, value, p)
+		}
+	}
+
+	if anyOf, ok := schema["anyOf"].([]interface{}); ok {
+		matched := false
+		for _, s := range anyOf {
+			if v.check(s, value, p) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			v.fail(p, "value does not match any of the allowed schemas")
+		}
+	}
+
+	if oneOf, ok := schema["oneOf"].([]interface{}); ok {
+		matches := 0
+		for _, s := range oneOf {
+			if v.check(s, value, p) {
+				matches++
+			}
+		}
+		if matches != 1 {
+			v.fail(p, "value matches %d of the schemas, expected exactly one", matches)
+		}
+	}
+
+	if not, ok := schema["not"]; ok && v.check(not, value, p) {
+		v.fail(p, "value matches a schema it must not")
+	}
+}
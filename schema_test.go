@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+const testSchema = `{
+	"type": "object",
+	"required": ["db", "name"],
+	"properties": {
+		"db": {
+			"type": "object",
+			"required": ["host", "port"],
+			"additionalProperties": false,
+			"properties": {
+				"host": {"type": "string", "minLength": 1},
+				"port": {"$ref": "#/definitions/port"}
+			}
+		},
+		"mode": {"enum": ["primary", "replica"]}
+	},
+	"definitions": {
+		"port": {"type": "integer", "minimum": 1, "maximum": 65535}
+	}
+}`
+
+func TestValidateTree(t *testing.T) {
+	schema := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(testSchema), &schema); err != nil {
+		t.Fatal(err)
+	}
+
+	valid := tree{
+		"name": "api",
+		"db":   map[string]interface{}{"host": "db", "port": float64(5432)},
+	}
+	if violations := validateTree(schema, valid, false); len(violations) != 0 {
+		t.Errorf("Expected no violations, recieved: %v", violations)
+	}
+
+	invalid := tree{
+		"mode": "leader",
+		"db":   map[string]interface{}{"host": "", "port": "5432", "user": "x"},
+	}
+	expected := []string{
+		"/: missing required key name",
+		"/db/host: expected at least 1 characters, got 0",
+		"/db/port: expected integer, got string",
+		"/db/user: key is not allowed",
+		"/mode: value leader is not one of [primary replica]",
+	}
+	violations := validateTree(schema, invalid, false)
+	if len(violations) != len(expected) {
+		t.Fatalf("Expected: %v\nRecieved: %v", expected, violations)
+	}
+	for i := range expected {
+		if violations[i] != expected[i] {
+			t.Errorf("Expected: %s\nRecieved: %s", expected[i], violations[i])
+		}
+	}
+
+	// strings read from Consul are accepted as numbers
+	lenient := tree{
+		"name": "api",
+		"db":   map[string]interface{}{"host": "db", "port": "5432"},
+	}
+	if violations := validateTree(schema, lenient, true); len(violations) != 0 {
+		t.Errorf("Expected no violations, recieved: %v", violations)
+	}
+}
+
+func TestValidateCircularRef(t *testing.T) {
+	schema := map[string]interface{}{}
+	err := json.Unmarshal([]byte(`{
+		"properties": {
+			"self": {"$ref": "#/properties/self"},
+			"a": {"$ref": "#/definitions/b"},
+			"node": {"$ref": "#/definitions/node"}
+		},
+		"definitions": {
+			"b": {"anyOf": [{"$ref": "#/properties/a"}]},
+			"node": {"type": "object", "additionalProperties": {"$ref": "#/definitions/node"}}
+		}
+	}`), &schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	violations := validateTree(schema, tree{
+		"self": "x",
+		"a":    "y",
+		"node": map[string]interface{}{"child": map[string]interface{}{}},
+	}, false)
+	expected := []string{
+		"/a: value does not match any of the allowed schemas",
+		"/self: invalid schema, circular reference, #/properties/self",
+	}
+	if !reflect.DeepEqual(violations, expected) {
+		t.Errorf("Expected: %v\nRecieved: %v", expected, violations)
+	}
+}
+
+func TestValidateBinaryString(t *testing.T) {
+	schema := map[string]interface{}{
+		"properties": map[string]interface{}{
+			"cert": map[string]interface{}{"type": "string", "minLength": float64(2)},
+		},
+	}
+
+	violations := validateTree(schema, tree{"cert": binaryValue{0xff, 0xfe, 0x00}}, false)
+	if len(violations) != 0 {
+		t.Errorf("Expected binary values to be strings, recieved: %v", violations)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// secretWords mark the keys whose values are masked when shown.
+var secretWords = []string{"password", "passwd", "secret", "token", "apikey", "api_key", "private", "credential"}
+
+// maskedValue is shown in place of a secret value.
+const maskedValue = "********"
+
+// showOptions control how much of a tree is shown.
+type showOptions struct {
+	depth  int // folders below this depth are collapsed, 0 shows all
+	values int // values are shown truncated to this many characters, 0 hides them
+}
+
+// show prints the values of the source as a sorted, indented tree with the
+// number of keys and bytes in every folder.
+func show(args []string) {
+	fs := flag.NewFlagSet("show", flag.ExitOnError)
+	depth := fs.Int("depth", 0, "number of folder levels to expand (0 expands all)")
+	values := fs.Int("values", 0, "show values truncated to this many characters, masking secret-looking keys (0 hides values)")
+	if arg := parseCommandFlags(fs, args); arg != "" {
+		usageErrorf("Unexpected argument, %s", arg)
+	}
+
+	checkSource()
+	if consulSource {
+		connect()
+	}
+	secrets = loadSecretKey(keyFile, passphraseEnv)
+	checkConsistency()
+	checkPrefixMode()
+
+	t := readSource()
+	count, size := t.stats()
+	name := srcKey + srcJSON.String() + srcDir + srcArchive
+	if name == "" {
+		// the whole store
+		name = "/"
+	}
+	fmt.Printf("%s (%s)\n", name, describeSize(count, size))
+	t.show(os.Stdout, "", "", 1, showOptions{depth: *depth, values: *values})
+}
+
+// leafValue returns the value of a leaf, without the metadata of an entry.
+func leafValue(v interface{}) interface{} {
+	if e, ok := v.(entry); ok {
+		return e.Value
+	}
+	return v
+}
+
+// stats returns the number of keys in the tree and the bytes of their values.
+func (t tree) stats() (count, size int) {
+	for _, v := range t {
+		if subTree, ok := v.(map[string]interface{}); ok {
+			c, s := tree(subTree).stats()
+			count, size = count+c, size+s
+			continue
+		}
+		count++
+		size += len(resolveBytes(leafValue(v)))
+	}
+	return
+}
+
+// show writes a line for every key of the tree, sorted, below the folder p.
+// Folders deeper than the depth limit are listed without their contents.
+func (t tree) show(w io.Writer, p, indent string, level int, opts showOptions) {
+	keys := []string{}
+	for k := range t {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for i, k := range keys {
+		branch, next := "|-- ", "|   "
+		if i == len(keys)-1 {
+			branch, next = "`-- ", "    "
+		}
+
+		name := unescapeName(k)
+		subTree, ok := t[k].(map[string]interface{})
+		if ok {
+			count, size := tree(subTree).stats()
+			fmt.Fprintf(w, "%s%s%s/ (%s)\n", indent, branch, name, describeSize(count, size))
+			if opts.depth == 0 || level < opts.depth {
+				tree(subTree).show(w, p+name+"/", indent+next, level+1, opts)
+			}
+			continue
+		}
+
+		data := resolveBytes(leafValue(t[k]))
+		line := indent + branch + name
+		if opts.values > 0 {
+			line += " = " + showValue(p+name, string(data), opts.values)
+		}
+		fmt.Fprintf(w, "%s (%s)\n", line, formatBytes(len(data)))
+	}
+}
+
+// showValue returns the value as shown for the key: quoted, truncated to the
+// limit, and masked when the key holds a secret.
+func showValue(key, value string, limit int) string {
+	if isMasked(key) {
+		return maskedValue
+	}
+
+	runes := []rune(value)
+	if len(runes) > limit {
+		return fmt.Sprintf("%q...", string(runes[:limit]))
+	}
+	return fmt.Sprintf("%q", value)
+}
+
+// isMasked reports whether the value of a key is masked when shown: its name
+// looks secret or the value was encrypted where it was read from.
+func isMasked(key string) bool {
+	return isSecretKey(key) || decrypted[strings.TrimSuffix(key, "/"+folderValue)]
+}
+
+// isSecretKey reports whether the last segment of a key looks like it names
+// a secret. The reserved child holding a folder's value is named by its
+// folder.
+func isSecretKey(key string) bool {
+	if strings.HasSuffix(key, "/"+folderValue) {
+		key = strings.TrimSuffix(key, "/"+folderValue)
+	}
+	name := strings.ToLower(key[strings.LastIndex(key, "/")+1:])
+	for _, word := range secretWords {
+		if strings.Contains(name, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// describeSize describes the number of keys and bytes in a folder.
+func describeSize(count, size int) string {
+	noun := "keys"
+	if count == 1 {
+		noun = "key"
+	}
+	return fmt.Sprintf("%d %s, %s", count, noun, formatBytes(size))
+}
+
+// formatBytes returns a size in bytes in a form that is easy to read.
+func formatBytes(size int) string {
+	switch {
+	case size >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(size)/(1<<20))
+	case size >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(size)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", size)
+}
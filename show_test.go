@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestShow(t *testing.T) {
+	values := tree{
+		"app": map[string]interface{}{
+			"name": "billing-service",
+			"db": map[string]interface{}{
+				"host":     "db.internal",
+				"password": "hunter2",
+			},
+		},
+		"ttl": entry{Value: "30", Flags: 1},
+	}
+
+	buf := &bytes.Buffer{}
+	values.show(buf, "", "", 1, showOptions{values: 7})
+	expected := "|-- app/ (3 keys, 33 B)\n" +
+		"|   |-- db/ (2 keys, 18 B)\n" +
+		"|   |   |-- host = \"db.inte\"... (11 B)\n" +
+		"|   |   `-- password = ******** (7 B)\n" +
+		"|   `-- name = \"billing\"... (15 B)\n" +
+		"`-- ttl = \"30\" (2 B)\n"
+	if buf.String() != expected {
+		t.Errorf("Expected:\n%s\nrecieved:\n%s", expected, buf.String())
+	}
+
+	buf.Reset()
+	values.show(buf, "", "", 1, showOptions{depth: 1})
+	expected = "|-- app/ (3 keys, 33 B)\n" +
+		"`-- ttl (2 B)\n"
+	if buf.String() != expected {
+		t.Errorf("Expected:\n%s\nrecieved:\n%s", expected, buf.String())
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	for size, expected := range map[int]string{12: "12 B", 2048: "2.0 KB", 3 << 20: "3.0 MB"} {
+		if formatted := formatBytes(size); formatted != expected {
+			t.Errorf("Expected %s for %d bytes, recieved: %s", expected, size, formatted)
+		}
+	}
+}
+
+func TestIsSecretKey(t *testing.T) {
+	for key, expected := range map[string]bool{
+		"db/password":                true,
+		"app/API_KEY":                true,
+		"password/length":            false,
+		"db/password/" + folderValue: true,
+		"app/port":                   false,
+	} {
+		if isSecretKey(key) != expected {
+			t.Errorf("Expected isSecretKey(%s) to be %t", key, expected)
+		}
+	}
+}
+
+func TestIsMaskedDecrypted(t *testing.T) {
+	defer func() { decrypted = map[string]bool{} }()
+
+	key := &secretKey{key: make([]byte, keySize)}
+	values := tree{"db": map[string]interface{}{
+		"conn": encryptLeaf(key, "db/conn", "postgres://u:hunter2@h/db"),
+		"port": "5432",
+	}}
+	values.decrypt(key, "")
+	if !isMasked("db/conn") || isMasked("db/port") {
+		t.Errorf("Expected only the value read encrypted to be masked, recieved: %v", decrypted)
+	}
+}
@@ -0,0 +1,660 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// streaming writes values as they are read, so that memory does not grow
+// with the number of keys: exports are written folder by folder and imports
+// are written leaf by leaf as the file is parsed.
+var streaming bool
+
+// checkStream ensures the run can be streamed: from a Consul key to a JSON
+// file or from a single JSON file to a Consul key, without the steps that
+// need every value at once.
+func checkStream() {
+	exporting := consulSource && destJSON != ""
+	importing := len(srcJSON) > 0 && destKey != ""
+	switch {
+	case !exporting && !importing:
+		usageErrorf("Only exports from -srcKey to -destJSON and imports from -srcJSON to -destKey can be streamed")
+	case len(rewrites) > 0 || rewriteFile != "":
+		usageErrorf("Keys cannot be rewritten while streaming")
+	case schemaFile != "":
+		usageErrorf("Values cannot be validated against a schema while streaming")
+	case exporting && prefixMode == "exact":
+		usageErrorf("The exact prefix mode reads a single key, which is not streamed")
+	case exporting && onConflict != "overwrite":
+		usageErrorf("Streaming replaces the destination file, -on-conflict=%s cannot be used", onConflict)
+	case importing && len(splitFiles(srcJSON)) > 1:
+		usageErrorf("Only a single file can be streamed, layered files are merged in memory")
+	case importing && srcJSON.String() == stdio:
+		usageErrorf("A streamed import reads its file twice, so it cannot be read from stdin")
+	case importing && substitute:
+		usageErrorf("Variables cannot be substituted while streaming")
+	}
+}
+
+// jsonStream writes a JSON object incrementally. A folder is only written
+// once a value is written in it, so folders emptied by filters are left out.
+type jsonStream struct {
+	w       *bufio.Writer
+	folders []streamFolder
+}
+
+// streamFolder is an object being written by a jsonStream.
+type streamFolder struct {
+	name    string
+	written bool
+	count   int
+}
+
+// newJSONStream starts writing an object to w.
+func newJSONStream(w io.Writer) *jsonStream {
+	s := &jsonStream{w: bufio.NewWriter(w), folders: []streamFolder{{written: true}}}
+	s.w.WriteString("{")
+	return s
+}
+
+// writeName writes the name of the next member of the folder at index i.
+func (s *jsonStream) writeName(i int, name string) {
+	if s.folders[i].count > 0 {
+		s.w.WriteString(",")
+	}
+	s.folders[i].count++
+
+	encoded, _ := json.Marshal(name)
+	s.w.Write(encoded)
+	s.w.WriteString(":")
+}
+
+// open starts a folder within the current one.
+func (s *jsonStream) open(name string) {
+	s.folders = append(s.folders, streamFolder{name: name})
+}
+
+// value writes a member of the current folder, along with any folders
+// holding it that are not written yet.
+func (s *jsonStream) value(name string, v interface{}) error {
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	for i := range s.folders {
+		if !s.folders[i].written {
+			s.writeName(i-1, s.folders[i].name)
+			s.w.WriteString("{")
+			s.folders[i].written = true
+		}
+	}
+	s.writeName(len(s.folders)-1, name)
+	_, err = s.w.Write(encoded)
+	return err
+}
+
+// close ends the current folder. It reports whether the folder was written.
+func (s *jsonStream) close() bool {
+	folder := s.folders[len(s.folders)-1]
+	s.folders = s.folders[:len(s.folders)-1]
+	if folder.written {
+		s.w.WriteString("}")
+	}
+	return folder.written
+}
+
+// finish ends the object and flushes what is left to write.
+func (s *jsonStream) finish() error {
+	s.w.WriteString("}")
+	return s.w.Flush()
+}
+
+// streamChild is a name in a folder, which may be a key, a folder or both.
+// The value of a key already read is kept with it.
+type streamChild struct {
+	key      string
+	isKey    bool
+	isFolder bool
+	value    interface{}
+}
+
+// groupChildren groups the keys listed in a folder by their name in the
+// folder, keeping those the match function accepts. It also reports whether
+// the folder itself is a key, a folder key ending in "/".
+func groupChildren(folder string, keys []string, match func(string) bool) (map[string]*streamChild, bool) {
+	children := map[string]*streamChild{}
+	self := false
+	for _, key := range keys {
+		if key == folder {
+			self = true
+			continue
+		}
+		if match != nil && !match(key) {
+			continue
+		}
+
+		name := strings.TrimSuffix(key[len(folder):], "/")
+		c, ok := children[name]
+		if !ok {
+			c = &streamChild{key: folder + name}
+			children[name] = c
+		}
+		if strings.HasSuffix(key, "/") {
+			c.isFolder = true
+		} else {
+			c.isKey = true
+		}
+	}
+	return children, self
+}
+
+// sortedNames returns the names of the children escaped as in a tree, sorted
+// as they are when a tree is marshaled, along with the name each stands for.
+func sortedNames(children map[string]*streamChild) ([]string, map[string]string) {
+	names := map[string]string{}
+	escaped := []string{}
+	for name := range children {
+		names[escapeName(name)] = name
+		escaped = append(escaped, escapeName(name))
+	}
+	sort.Strings(escaped)
+	return escaped, names
+}
+
+// streamer walks the folders below a key and writes their values as it goes.
+type streamer struct {
+	out      *jsonStream
+	patterns []string
+	progress *progress
+	folders  int
+}
+
+// list returns the keys and folders directly in a folder.
+func (s *streamer) list(folder string) ([]string, error) {
+	keys, meta, err := srcKV.Keys(folder, "/", queryOptions())
+	if err != nil {
+		return nil, &consulError{"list", folder, err}
+	}
+	if s.folders == 0 {
+		reportStaleness(meta)
+		source.Index = meta.LastIndex
+	}
+	s.folders++
+	return keys, nil
+}
+
+// walk writes the values selected by the key under the prefix mode. The tree
+// is rooted at the last segment of the key, as with readConsulTree. It
+// returns the number of names found at the root.
+func (s *streamer) walk(key string) (int, error) {
+	// list the key's own folder, narrowed to names starting with the key
+	keys, err := s.list(strings.TrimSuffix(key, "/"))
+	if err != nil {
+		return 0, err
+	}
+
+	root := key[:strings.LastIndex(strings.TrimSuffix(key, "/"), "/")+1]
+	children, _ := groupChildren(root, keys, func(child string) bool {
+		if prefixMode == "raw" || key == "" {
+			return strings.HasPrefix(child, key)
+		}
+		return child == key || child == key+"/"
+	})
+
+	escaped, names := sortedNames(children)
+	for _, name := range escaped {
+		if err := s.writeChild(name, names[name], children[names[name]]); err != nil {
+			return 0, err
+		}
+	}
+	return len(children), nil
+}
+
+// writeChild writes a child of the current folder under its escaped name,
+// reading the value of its key and walking its folder. The path is the
+// child's key in the tree being written.
+func (s *streamer) writeChild(name, p string, c *streamChild) error {
+	value := c.value
+	if value == nil && c.isKey {
+		var err error
+		if value, err = s.read(c.key); err != nil {
+			return err
+		}
+	}
+	if !c.isFolder {
+		if value == nil {
+			return nil
+		}
+		return s.out.value(name, s.leaf(p, value))
+	}
+
+	folder := c.key + "/"
+	keys, err := s.list(folder)
+	if err != nil {
+		return err
+	}
+	children, self := groupChildren(folder, keys, nil)
+
+	// a value stored in chunks is the value of the folder's key
+	if chunks, ok := children[chunkFolder]; ok && chunks.isFolder {
+		joined, err := s.chunkedValue(c.key)
+		if err != nil {
+			return err
+		}
+		if joined != nil {
+			value = joined
+			chunks.isFolder = false
+			if !chunks.isKey {
+				delete(children, chunkFolder)
+			}
+		}
+	}
+	// the folder's own key, such as "app/", is the child with an empty name
+	// unless it is an empty folder key alone, which is an empty folder
+	if self {
+		own, err := s.read(folder)
+		if err != nil {
+			return err
+		}
+		if own != nil && len(children) == 0 && value == nil && isEmptyValue(own) {
+			return s.out.value(name, map[string]interface{}{})
+		} else if own != nil {
+			if _, ok := children[""]; !ok {
+				children[""] = &streamChild{key: folder}
+			}
+			children[""].value = own
+		}
+	}
+	if len(children) == 0 && value != nil {
+		return s.out.value(name, s.leaf(p, value))
+	}
+
+	s.out.open(name)
+	escaped, names := sortedNames(children)
+	if value != nil {
+		escaped = append(escaped, folderValue)
+		sort.Strings(escaped)
+	}
+	for _, child := range escaped {
+		if child == folderValue && value != nil {
+			err = s.out.value(folderValue, s.leaf(p, value))
+		} else {
+			err = s.writeChild(child, p+"/"+names[child], children[names[child]])
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	s.out.close()
+	return nil
+}
+
+// read returns the value of a key, or nil when it is filtered out or gone. A
+// folder key without a value or flags reads as an empty string, as when a
+// tree is built.
+func (s *streamer) read(key string) (interface{}, error) {
+	if !exportFilter.keep(key) {
+		return nil, nil
+	}
+	pair, _, err := srcKV.Get(key, queryOptions())
+	if err != nil {
+		return nil, &consulError{"read", key, err}
+	} else if pair == nil {
+		return nil, nil
+	}
+
+	v := pairValue(pair)
+	if strings.HasSuffix(key, "/") && isEmptyValue(v) {
+		v = ""
+	}
+	return v, nil
+}
+
+// chunkedValue reads the value stored in chunks below a key, or nil when the
+// chunk folder has no manifest.
+func (s *streamer) chunkedValue(key string) (interface{}, error) {
+	folder := key + "/" + chunkFolder + "/"
+	pairs, _, err := srcKV.List(folder, queryOptions())
+	if err != nil {
+		return nil, &consulError{"list", folder, err}
+	}
+
+	chunks := map[string]interface{}{}
+	for _, pair := range pairs {
+		if name := pair.Key[len(folder):]; !strings.Contains(name, "/") {
+			chunks[name] = pairValue(pair)
+		}
+	}
+	manifest, ok := chunks[chunkManifestName]
+	if !ok {
+		return nil, nil
+	}
+	return joinChunk(key, chunks, manifest), nil
+}
+
+// leaf counts a value as it is written, encrypting it if selected.
+func (s *streamer) leaf(p string, v interface{}) interface{} {
+	s.progress.add(len(resolveBytes(leafValue(v))))
+	summary.Created.add(p)
+	if len(s.patterns) > 0 {
+		v = encryptValue(secrets, s.patterns, p, v)
+	}
+	return v
+}
+
+// streamConsulTree exports the values at the key to a JSON file, or stdout
+// for "-", writing them as the folders below the key are walked. Memory use
+// is bounded by the widest folder rather than the number of keys, but the
+// values are not read from a single snapshot of the store.
+func streamConsulTree(key, filename string) {
+	if prefixMode == "folder" {
+		key = strings.TrimSuffix(key, "/")
+	}
+
+	f, err := createAtomic(filename, outputMode())
+	if err != nil {
+		fatalf("Failed to write json data to file, %s => {%s}", filename, err)
+	}
+
+	s := &streamer{out: newJSONStream(f), patterns: encryptPatterns(), progress: newProgress("Exporting", 0)}
+	found, err := s.walk(key)
+	if err == nil && found == 0 {
+		f.abort()
+		fatal(classError, logFields{Key: key, Operation: "read", Datacenter: source.Datacenter}, "Failed to find any data, %s", key)
+	}
+	if err == nil {
+		err = s.out.finish()
+	}
+	if err == nil {
+		err = f.commit()
+	}
+	if err != nil {
+		f.abort()
+		if e, ok := err.(*consulError); ok {
+			consulFailed(e.operation, e.key, e.err, "Failed to stream %s to %s => {%s}", key, filename, err)
+		}
+		fatalf("Failed to stream %s to %s => {%s}", key, filename, err)
+	}
+
+	s.progress.done()
+	summary.Read, summary.Bytes = s.progress.keys, s.progress.bytes
+	summary.report()
+}
+
+// leafFunc is called for each leaf of a JSON document with its path in the
+// tree, the top level name the path starts with, and whether the leaf is a
+// top level value.
+type leafFunc func(p, top string, topLeaf bool, v interface{}) error
+
+// walkJSON reads a JSON document holding a tree token by token, calling fn
+// for every leaf as soon as it is parsed. The leaves are those a tree read
+// from the document would have.
+func walkJSON(r io.Reader, fn leafFunc) error {
+	d := json.NewDecoder(r)
+	tok, err := d.Token()
+	if err != nil {
+		return err
+	}
+	if tok != json.Delim('{') {
+		return fmt.Errorf("expected an object, found %v", tok)
+	}
+	return walkMembers(d, "", "", fn)
+}
+
+// walkMembers reads the members of an object in the folder at the prefix, up
+// to the end of the object.
+func walkMembers(d *json.Decoder, prefix, top string, fn leafFunc) error {
+	for d.More() {
+		tok, err := d.Token()
+		if err != nil {
+			return err
+		}
+		if err := walkValue(d, prefix, tok.(string), top, fn); err != nil {
+			return err
+		}
+	}
+	_, err := d.Token()
+	return err
+}
+
+// walkValue reads the value of the member with the name in the folder at the
+// prefix, a leaf or a subtree.
+func walkValue(d *json.Decoder, prefix, name, top string, fn leafFunc) error {
+	if prefix == "" {
+		top = unescapeName(name)
+	}
+	p := leafKey(prefix, name)
+
+	tok, err := d.Token()
+	if err != nil {
+		return err
+	}
+	switch tok {
+	case json.Delim('['):
+		return fmt.Errorf("arrays are not supported, %s", p)
+	case json.Delim('{'):
+	default:
+		return fn(p, top, prefix == "", tok)
+	}
+
+	folder := prefix + unescapeName(name) + "/"
+	if !d.More() {
+		// an empty object is a folder key
+		if _, err := d.Token(); err != nil {
+			return err
+		}
+		return fn(folder, top, false, "")
+	}
+
+	tok, err = d.Token()
+	if err != nil {
+		return err
+	}
+	first := tok.(string)
+	if !isTagName(first) {
+		if err := walkValue(d, folder, first, top, fn); err != nil {
+			return err
+		}
+		return walkMembers(d, folder, top, fn)
+	}
+
+	// tagged objects, such as entries and binary values, are read whole
+	fields := map[string]interface{}{}
+	for field := first; ; {
+		var v interface{}
+		if err := d.Decode(&v); err != nil {
+			return err
+		}
+		fields[field] = v
+		if !d.More() {
+			break
+		}
+		if tok, err = d.Token(); err != nil {
+			return err
+		}
+		field = tok.(string)
+	}
+	if _, err := d.Token(); err != nil {
+		return err
+	}
+
+	leaves := map[string]interface{}{}
+	t := tree{name: fields}
+	t.decodeEntries()
+	t.collect(prefix, leaves)
+	for _, key := range sortedKeys(leaves) {
+		if err := fn(key, top, prefix == "" && key == p, leaves[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// importer writes the leaves of a JSON file to Consul as they are parsed.
+// A planning pass reads what is stored and decides what to write, keeping a
+// flag per leaf so the writing pass does not read Consul again.
+type importer struct {
+	key       string
+	filename  string
+	write     bool
+	oversized map[string]int
+	conflicts []string
+	leaves    int
+	planned   []bool
+	stale     map[string]map[string]string
+	// the keys stored in the folders holding the current leaf
+	folders  map[string]map[string]bool
+	progress *progress
+}
+
+// pass reads the file once, planning or writing each leaf. The function exits
+// if the file cannot be read.
+func (im *importer) pass(filename string) {
+	file, err := openInput(filename)
+	if err != nil {
+		fatalf("Failed to open srcJSON file => {%s}", err)
+	}
+	defer file.Close()
+
+	im.filename, im.leaves = filename, 0
+	if err := walkJSON(file, im.leaf); err != nil {
+		fatal(classValidation, logFields{Operation: "read"}, "Failed to decode json in file, %s => {%s}", filename, err)
+	}
+}
+
+// leaf plans or writes a single leaf of the file.
+func (im *importer) leaf(p, top string, topLeaf bool, v interface{}) error {
+	target := targetKey(im.key, p, top, topLeaf)
+	v = decryptValue(secrets, p, v)
+	index := im.leaves
+	im.leaves++
+	if !im.write {
+		im.planned = append(im.planned, im.plan(p, target, v))
+		return nil
+	}
+
+	if index >= len(im.planned) {
+		fatal(classValidation, logFields{Operation: "read"}, "File changed since it was planned, %s has more values than before", im.filename)
+	}
+	if !im.planned[index] {
+		im.progress.add(0)
+		return nil
+	}
+
+	values := map[string]interface{}{target: v}
+	size := len(resolveBytes(leafValue(v)))
+	if chunkValues && size > consulValueLimit {
+		splitValue(values, target)
+	}
+	deleteStale(im.stale[target])
+	for _, key := range sortedKeys(values) {
+		push(key, values[key])
+	}
+	im.progress.add(size)
+	return nil
+}
+
+// plan decides whether a leaf is written, recording its outcome in the
+// summary. Which keys exist is found by listing each folder once; values are
+// only read for keys that exist when the strategy compares them. Every key of
+// a value stored in chunks is written again when any of them changed.
+func (im *importer) plan(p, target string, v interface{}) bool {
+	if !importFilter.keep(p) || !writableKey(target) {
+		return false
+	}
+
+	values := map[string]interface{}{target: v}
+	if size := len(resolveBytes(leafValue(v))); size > consulValueLimit {
+		im.oversized[target] = size
+	}
+	if chunkValues {
+		values = chunk(values)
+	}
+
+	stored := im.storedKeys(target[:strings.LastIndex(target, "/")+1])
+	existing := map[string]interface{}{}
+	if stored[target] {
+		existing[target] = storedValue(target, values)
+	}
+	if stored[target+"/"] {
+		// only a key with children may have chunks
+		for _, k := range chunkKeys(target) {
+			existing[k] = storedValue(k, values)
+		}
+	}
+	if stale := takeStale(values, existing); len(stale) > 0 {
+		im.stale[target] = stale
+	}
+
+	write, conflicts := resolveConflicts(onConflict, values, existing)
+	im.conflicts = append(im.conflicts, conflicts...)
+	return len(write) > 0
+}
+
+// storedKeys returns the keys stored in a folder, and the folders in it with
+// a trailing "/". Only the listings of the folders holding the current leaf
+// are kept.
+func (im *importer) storedKeys(folder string) map[string]bool {
+	if keys, ok := im.folders[folder]; ok {
+		return keys
+	}
+	for f := range im.folders {
+		if !strings.HasPrefix(folder, f) {
+			delete(im.folders, f)
+		}
+	}
+
+	keys, _, err := destKV.Keys(folder, "/", nil)
+	if err != nil {
+		consulFailed("compare", folder, err, "Error retrieving data for specified key, %s => {%s}", folder, err)
+	}
+	stored := map[string]bool{}
+	for _, key := range keys {
+		stored[key] = true
+	}
+	im.folders[folder] = stored
+	return stored
+}
+
+// storedValue returns the value of an existing key as compared with the
+// values written. It is only read when the key is written and the strategy
+// compares values, which "skip" and "fail" do not.
+func storedValue(key string, values map[string]interface{}) interface{} {
+	if _, ok := values[key]; !ok || onConflict == "skip" || onConflict == "fail" {
+		return replacedValue{}
+	}
+	if old, ok := existingKey(key)[key]; ok {
+		return old
+	}
+	return replacedValue{}
+}
+
+// streamJSONToConsul imports a JSON file to the key, writing each leaf as it
+// is parsed. The file is read twice: first to check the values and report
+// what will change, failing before anything is written, then to write the
+// leaves the plan selected.
+func streamJSONToConsul(filename, key string) {
+	im := &importer{key: key, oversized: map[string]int{}, stale: map[string]map[string]string{}, folders: map[string]map[string]bool{}}
+	im.pass(filename)
+	refuseOversized(im.oversized)
+	if len(im.conflicts) > 0 {
+		refuseConflicts(im.conflicts)
+	}
+	logf("info", logFields{Operation: "write", Datacenter: destDatacenter}, "Planned changes with -on-conflict=%s: %d to create, %d to update, %d unchanged, %d to skip",
+		onConflict, summary.Created.count, summary.Updated.count, summary.Unchanged.count, summary.Skipped.count)
+
+	summary.Read = im.leaves
+	im.write, im.progress = true, newProgress("Writing", im.leaves)
+	im.pass(filename)
+	im.progress.done()
+	if im.leaves != len(im.planned) {
+		fatal(classValidation, logFields{Operation: "read"}, "File changed since it was planned, %s has fewer values than before", filename)
+	}
+	summary.report()
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestJSONStream(t *testing.T) {
+	buf := &bytes.Buffer{}
+	s := newJSONStream(buf)
+	s.value("a", "1")
+	s.open("b")
+	s.open("empty")
+	if s.close() {
+		t.Error("Expected a folder without values not to be written")
+	}
+	s.value("c", binaryValue{0xff})
+	s.close()
+	s.value("d", map[string]interface{}{})
+	if err := s.finish(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"a":"1","b":{"c":{"$base64":"/w=="}},"d":{}}`
+	if buf.String() != expected {
+		t.Errorf("Expected: %s\nRecieved: %s", expected, buf.String())
+	}
+}
+
+func TestGroupChildren(t *testing.T) {
+	keys := []string{"app/", "app/a", "app/a/", "app/b/", "app/c"}
+	children, self := groupChildren("app/", keys, nil)
+	if !self {
+		t.Error("Expected the folder key to be found")
+	}
+
+	expected := map[string]*streamChild{
+		"a": {key: "app/a", isKey: true, isFolder: true},
+		"b": {key: "app/b", isFolder: true},
+		"c": {key: "app/c", isKey: true},
+	}
+	if !reflect.DeepEqual(children, expected) {
+		t.Errorf("Expected: %v\nRecieved: %v", expected, children)
+	}
+}
+
+func TestWalkJSON(t *testing.T) {
+	values, _ := trickyTree()
+	values.add("app/meta", entry{Value: "x", Flags: 7})
+	values.add("app/bin", binaryValue{0xff, 0xfe})
+	values.add("app/n", float64(3))
+	data, err := json.Marshal(values)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaves := map[string]interface{}{}
+	err = walkJSON(bytes.NewReader(data), func(p, top string, topLeaf bool, v interface{}) error {
+		leaves[p] = v
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded := tree{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	decoded.decodeEntries()
+	if expected := decoded.flatten(); !reflect.DeepEqual(leaves, expected) {
+		t.Errorf("Expected: %v\nRecieved: %v", expected, leaves)
+	}
+}
+
+func TestWalkJSONRejectsArrays(t *testing.T) {
+	err := walkJSON(strings.NewReader(`{"a":{"b":[1]}}`), func(p, top string, topLeaf bool, v interface{}) error {
+		return nil
+	})
+	if err == nil {
+		t.Error("Expected arrays to be rejected")
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// keySampleSize is how many keys of each outcome are named in the log.
+const keySampleSize = 10
+
+// keyCount counts the keys with an outcome, keeping the first few to name in
+// the log so a run over many keys does not hold every one in memory.
+type keyCount struct {
+	count  int
+	sample []string
+	// every key, kept only while a report listing them is written
+	all []string
+}
+
+// add counts the keys.
+func (c *keyCount) add(keys ...string) {
+	for _, key := range keys {
+		c.count++
+		if len(c.sample) < keySampleSize {
+			c.sample = append(c.sample, key)
+		}
+	}
+}
+
+// addListed counts the keys, keeping all of them when a report is written.
+func (c *keyCount) addListed(keys ...string) {
+	c.add(keys...)
+	if reportFile != "" {
+		c.all = append(c.all, keys...)
+	}
+}
+
+// String names the sampled keys and how many more there are.
+func (c keyCount) String() string {
+	names := strings.Join(c.sample, ", ")
+	if more := c.count - len(c.sample); more > 0 {
+		names += fmt.Sprintf(" and %d more", more)
+	}
+	return names
+}
+
+// runSummary collects what happened during a run so it can be reported once
+// the run finishes.
+type runSummary struct {
+	Filtered   keyCount
+	Dropped    keyCount
+	Collisions keyCount
+
+	// the outcome of each key under the conflict strategy
+	Created   keyCount
+	Updated   keyCount
+	Unchanged keyCount
+	Skipped   keyCount
+	Kept      keyCount
+	Deleted   keyCount
+	Failed    keyCount
+	// keys written over a destination file that was not read, so whether
+	// they were created or updated is unknown
+	Replaced keyCount
+
+	// the keys read from the source and the bytes of the values written
+	Read  int
+	Bytes int
+}
+
+var (
+	summary runSummary
+	// runStarted is when the run started.
+	runStarted = time.Now()
+	// reportFile is written with the summary of the run as JSON.
+	reportFile string
+)
+
+// summaryReport is the summary of a run as written to the report file.
+type summaryReport struct {
+	OnConflict      string   `json:"on_conflict"`
+	Read            int      `json:"read"`
+	Created         int      `json:"created"`
+	Updated         int      `json:"updated"`
+	Unchanged       int      `json:"unchanged"`
+	Deleted         int      `json:"deleted"`
+	Skipped         int      `json:"skipped"`
+	Kept            int      `json:"kept"`
+	Replaced        int      `json:"replaced"`
+	Failed          int      `json:"failed"`
+	Filtered        int      `json:"filtered"`
+	Dropped         int      `json:"dropped"`
+	Bytes           int      `json:"bytes"`
+	DurationSeconds float64  `json:"duration_seconds"`
+	SkippedKeys     []string `json:"skipped_keys,omitempty"`
+	FailedKeys      []string `json:"failed_keys,omitempty"`
+}
+
+// report logs the summary of the run, naming a sample of the keys, and writes
+// it to the report file when one is given, listing every skipped and failed
+// key.
+func (s *runSummary) report() {
+	activeProgress.done()
+	duration := time.Since(runStarted)
+
+	if s.Filtered.count > 0 {
+		logf("info", logFields{}, "Filtered out %d keys: %s", s.Filtered.count, s.Filtered)
+	}
+	if s.Dropped.count > 0 {
+		logf("info", logFields{}, "Dropped %d keys by rewrite rules: %s", s.Dropped.count, s.Dropped)
+	}
+	if s.Collisions.count > 0 {
+		logf("warning", logFields{}, "%d rewritten keys collide: %s", s.Collisions.count, s.Collisions)
+	}
+
+	logf("info", logFields{Datacenter: destDatacenter}, "Keys written with -on-conflict=%s: %d created, %d updated, %d unchanged, %d skipped, %d kept, %d deleted, %d failed",
+		onConflict, s.Created.count, s.Updated.count, s.Unchanged.count, s.Skipped.count, s.Kept.count, s.Deleted.count, s.Failed.count)
+	if s.Replaced.count > 0 {
+		logf("info", logFields{}, "Replaced the destination with %d keys, without comparing what it held", s.Replaced.count)
+	}
+	if s.Skipped.count > 0 {
+		logf("info", logFields{}, "Skipped %d existing keys: %s", s.Skipped.count, s.Skipped)
+	}
+	if s.Failed.count > 0 {
+		logf("error", logFields{Operation: "write", Datacenter: destDatacenter}, "Failed to write %d keys: %s", s.Failed.count, s.Failed)
+	}
+	logf("info", logFields{}, "Read %d keys and wrote %s in %s", s.Read, formatBytes(s.Bytes), duration)
+
+	if reportFile != "" {
+		s.writeReport(reportFile, duration)
+	}
+}
+
+// writeReport writes the summary to a file as JSON, or to stdout for "-".
+func (s *runSummary) writeReport(filename string, duration time.Duration) {
+	data, err := json.MarshalIndent(summaryReport{
+		OnConflict:      onConflict,
+		Read:            s.Read,
+		Created:         s.Created.count,
+		Updated:         s.Updated.count,
+		Unchanged:       s.Unchanged.count,
+		Deleted:         s.Deleted.count,
+		Skipped:         s.Skipped.count,
+		Kept:            s.Kept.count,
+		Replaced:        s.Replaced.count,
+		Failed:          s.Failed.count,
+		Filtered:        s.Filtered.count,
+		Dropped:         s.Dropped.count,
+		Bytes:           s.Bytes,
+		DurationSeconds: duration.Seconds(),
+		SkippedKeys:     s.Skipped.all,
+		FailedKeys:      s.Failed.all,
+	}, "", "  ")
+	if err != nil {
+		fatalf("Error marshaling data for JSON => {%s}", err)
+	}
+
+	if err := writeFileAtomic(filename, append(data, '\n'), outputMode()); err != nil {
+		fatalf("Failed to write report, %s => {%s}", filename, err)
+	}
+}
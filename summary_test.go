@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteReport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "report")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "report.json")
+	reportFile = filename
+	defer func() { reportFile = "" }()
+
+	s := runSummary{Read: 4, Bytes: 12}
+	s.Created.add("app/a", "app/b")
+	s.Skipped.addListed("app/c")
+	s.Failed.addListed("app/d")
+	s.writeReport(filename, 1500*time.Millisecond)
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := summaryReport{}
+	if err := json.Unmarshal(data, &report); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := summaryReport{
+		OnConflict:      onConflict,
+		Read:            4,
+		Created:         2,
+		Skipped:         1,
+		Failed:          1,
+		Bytes:           12,
+		DurationSeconds: 1.5,
+		SkippedKeys:     []string{"app/c"},
+		FailedKeys:      []string{"app/d"},
+	}
+	if !reflect.DeepEqual(report, expected) {
+		t.Errorf("Expected: %+v\nRecieved: %+v", expected, report)
+	}
+}
+
+func TestKeyCountSample(t *testing.T) {
+	c := keyCount{}
+	for i := 0; i < keySampleSize+3; i++ {
+		c.addListed(fmt.Sprintf("app/%02d", i))
+	}
+	if c.count != keySampleSize+3 || len(c.sample) != keySampleSize || c.all != nil {
+		t.Errorf("Expected a capped sample without a report, recieved: %d %v %v", c.count, c.sample, c.all)
+	}
+	if names := c.String(); !strings.HasPrefix(names, "app/00, app/01") || !strings.HasSuffix(names, "app/09 and 3 more") {
+		t.Errorf("Expected the sample and the rest counted, recieved: %s", names)
+	}
+}
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
-	"log"
 	"strconv"
 	"strings"
+	"unicode/utf8"
 
 	consul "github.com/hashicorp/consul/api"
 )
@@ -12,6 +14,146 @@ import (
 // tree is a structure used to build a representation of the consul config.
 type tree map[string]interface{}
 
+// folderValue is the reserved child holding the value of a key that is also a
+// folder, since Consul can store both "a" and "a/b".
+var folderValue string
+
+// leafKey returns the key of the child k of the folder at the prefix, which
+// ends in "/" below the root. The reserved child is the folder's own key.
+func leafKey(prefix, k string) string {
+	if k == folderValue && prefix != "" {
+		return strings.TrimSuffix(prefix, "/")
+	}
+	return prefix + unescapeName(k)
+}
+
+// entry is a value together with the metadata Consul keeps for its key. It
+// takes the place of a plain value when exporting with metadata.
+type entry struct {
+	Value       interface{}
+	Flags       uint64
+	CreateIndex uint64
+	ModifyIndex uint64
+	LockIndex   uint64
+	Session     string
+}
+
+// entryValueTag marks an object in a JSON file as an entry rather than a subtree.
+const entryValueTag = "$value"
+
+// base64Tag marks an object in a JSON file as a binary value.
+const base64Tag = "$base64"
+
+// binaryValue is a value that is not valid UTF-8, which JSON strings cannot hold.
+type binaryValue []byte
+
+// MarshalJSON writes the value as a tagged object holding its base64 encoding.
+func (b binaryValue) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]string{base64Tag: base64.StdEncoding.EncodeToString(b)})
+}
+
+// bytesValue returns the value for the bytes of a key: a string, or a binary
+// value when the bytes are not valid UTF-8.
+func bytesValue(data []byte) interface{} {
+	if utf8.Valid(data) {
+		return string(data)
+	}
+	return binaryValue(data)
+}
+
+// decodeValue reads a value decoded from JSON, turning the tagged object
+// written for a binary value back into its bytes.
+func decodeValue(v interface{}) interface{} {
+	fields, ok := v.(map[string]interface{})
+	if !ok || len(fields) != 1 {
+		return v
+	}
+	encoded, ok := fields[base64Tag].(string)
+	if !ok {
+		return v
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		fatal(classValidation, logFields{}, "Invalid base64 value => {%s}", err)
+	}
+	return binaryValue(data)
+}
+
+// MarshalJSON writes the entry as an object of tagged fields. The flags and
+// indexes are written as strings, since JSON numbers lose precision above 2^53.
+func (e entry) MarshalJSON() ([]byte, error) {
+	fields := map[string]interface{}{
+		entryValueTag:  e.Value,
+		"$flags":       strconv.FormatUint(e.Flags, 10),
+		"$createIndex": strconv.FormatUint(e.CreateIndex, 10),
+		"$modifyIndex": strconv.FormatUint(e.ModifyIndex, 10),
+		"$lockIndex":   strconv.FormatUint(e.LockIndex, 10),
+	}
+	if e.Session != "" {
+		fields["$session"] = e.Session
+	}
+	return json.Marshal(fields)
+}
+
+// String returns a string representation of the entry.
+func (e entry) String() string {
+	return fmt.Sprintf("%v (flags: %d)", e.Value, e.Flags)
+}
+
+// decodeEntry reads an entry from the tagged fields decoded from JSON.
+func decodeEntry(fields map[string]interface{}) entry {
+	e := entry{Value: decodeValue(fields[entryValueTag])}
+	e.Flags = toUint("$flags", fields["$flags"])
+	e.CreateIndex = toUint("$createIndex", fields["$createIndex"])
+	e.ModifyIndex = toUint("$modifyIndex", fields["$modifyIndex"])
+	e.LockIndex = toUint("$lockIndex", fields["$lockIndex"])
+	e.Session, _ = fields["$session"].(string)
+	return e
+}
+
+// maxExactNumber is the largest integer a JSON number decoded as a float64
+// holds exactly.
+const maxExactNumber = 1 << 53
+
+// toUint converts a tagged field decoded from JSON to an unsigned integer. The
+// field is a decimal string, or a number small enough to be exact; the
+// function exits otherwise rather than keep a rounded value.
+func toUint(name string, v interface{}) uint64 {
+	switch val := v.(type) {
+	case float64:
+		if val < 0 || val >= maxExactNumber || val != float64(uint64(val)) {
+			fatal(classValidation, logFields{}, "Invalid %s, %v, expected an integer below 2^53 or a decimal string", name, val)
+		}
+		return uint64(val)
+	case string:
+		n, err := strconv.ParseUint(val, 10, 64)
+		if err != nil {
+			fatal(classValidation, logFields{}, "Invalid %s, %q => {%s}", name, val, err)
+		}
+		return n
+	}
+	return 0
+}
+
+// decodeEntries replaces the tagged objects written for entries and binary
+// values with the values themselves, so they are not mistaken for subtrees.
+func (t tree) decodeEntries() {
+	for k, v := range t {
+		subTree, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		if _, isBinary := subTree[base64Tag]; isBinary {
+			t[k] = decodeValue(subTree)
+		} else if _, isEntry := subTree[entryValueTag]; isEntry {
+			t[k] = decodeEntry(subTree)
+		} else {
+			tree(subTree).decodeEntries()
+		}
+	}
+}
+
 // String returns a string representation of the Tree.
 func (t tree) String() (repr string) {
 	for k, v := range t {
@@ -35,15 +177,44 @@ func (t tree) add(k string, v interface{}) {
 
 	// split the key by segments to allow building a trie
 	path := strings.Split(k, "/")
+	name := escapeName(path[0])
 
-	if len(path) == 1 { // on the last key portion
-		t[k] = v
+	if len(path) == 2 && path[1] == "" { // a folder key, such as "app/"
+		switch existing := t[name].(type) {
+		case map[string]interface{}:
+			if len(existing) > 0 || !isEmptyValue(v) {
+				tree(existing).addFolderKey(v)
+			}
+		case nil:
+			// an empty folder key is an empty folder
+			t[name] = map[string]interface{}{}
+			if !isEmptyValue(v) {
+				tree(t[name].(map[string]interface{})).addFolderKey(v)
+			}
+		default:
+			t[name] = map[string]interface{}{folderValue: existing}
+			tree(t[name].(map[string]interface{})).addFolderKey(v)
+		}
+	} else if len(path) == 1 { // on the last key portion
+		if subTree, ok := t[name].(map[string]interface{}); ok {
+			// the key is also a folder
+			tree(subTree).keepFolderKey()
+			subTree[folderValue] = v
+		} else {
+			t[name] = v
+		}
 	} else {
-		subKey := path[0]
+		subKey := name
 		subTree, exists := t[subKey]
 		if !exists {
 			t[subKey] = map[string]interface{}{}
 			subTree = t[subKey] // make a reference to the subtree
+		} else if folder, ok := subTree.(map[string]interface{}); ok {
+			tree(folder).keepFolderKey()
+		} else {
+			// the value becomes the folder's own value
+			t[subKey] = map[string]interface{}{folderValue: subTree}
+			subTree = t[subKey]
 		}
 
 		// insert the value at the last brnach of the trie
@@ -51,11 +222,80 @@ func (t tree) add(k string, v interface{}) {
 	}
 }
 
-// build adds a series of KVPairs to the tree.
+// addFolderKey stores the value of the folder key of this folder, such as
+// "app/" for the folder "app", in the child with an empty name. The child is
+// itself a folder when keys such as "app//b" exist.
+func (t tree) addFolderKey(v interface{}) {
+	if subTree, ok := t[""].(map[string]interface{}); ok {
+		subTree[folderValue] = v
+	} else {
+		t[""] = v
+	}
+}
+
+// keepFolderKey turns an empty folder, which stands for an empty folder key,
+// into an explicit folder key before anything else is added to it.
+func (t tree) keepFolderKey() {
+	if len(t) == 0 {
+		t[""] = ""
+	}
+}
+
+// isEmptyValue reports whether a folder key's value can be left out, leaving
+// an empty folder: it has no bytes and no flags.
+func isEmptyValue(v interface{}) bool {
+	if e, ok := v.(entry); ok {
+		return e.Flags == 0 && len(resolveBytes(e.Value)) == 0
+	}
+	return len(resolveBytes(v)) == 0
+}
+
+// flatten returns the leaves of the tree keyed by their full path. Empty
+// folders are returned as folder keys, ending in "/" with an empty value.
+func (t tree) flatten() map[string]interface{} {
+	leaves := map[string]interface{}{}
+	t.collect("", leaves)
+	return leaves
+}
+
+// collect adds the leaves of the tree below the prefix to a flat map.
+func (t tree) collect(prefix string, leaves map[string]interface{}) {
+	for k, v := range t {
+		subTree, ok := v.(map[string]interface{})
+		if ok && len(subTree) == 0 {
+			leaves[prefix+unescapeName(k)+"/"] = ""
+		} else if ok {
+			tree(subTree).collect(prefix+unescapeName(k)+"/", leaves)
+		} else {
+			leaves[leafKey(prefix, k)] = v
+		}
+	}
+}
+
+// build adds a series of KVPairs to the tree. When exporting metadata the
+// values are stored as entries.
 func (t tree) build(kvs consul.KVPairs, skip int) {
 	for _, pair := range kvs {
-		// use raw bytes if transferring from Consul key to Consul key
-		t.add(pair.Key[skip:], string(pair.Value))
+		if !exportFilter.keep(pair.Key) {
+			continue
+		}
+
+		t.add(pair.Key[skip:], pairValue(pair))
+	}
+}
+
+// pairValue returns the value of a pair, as an entry when exporting metadata.
+func pairValue(pair *consul.KVPair) interface{} {
+	if !exportMeta {
+		return bytesValue(pair.Value)
+	}
+	return entry{
+		Value:       bytesValue(pair.Value),
+		Flags:       pair.Flags,
+		CreateIndex: pair.CreateIndex,
+		ModifyIndex: pair.ModifyIndex,
+		LockIndex:   pair.LockIndex,
+		Session:     pair.Session,
 	}
 }
 
@@ -65,6 +305,8 @@ func resolveBytes(v interface{}) []byte {
 	switch val := v.(type) {
 	case []byte:
 		return val
+	case binaryValue:
+		return val
 	case string:
 		return []byte(val)
 	case int64:
@@ -74,37 +316,31 @@ func resolveBytes(v interface{}) []byte {
 	case int:
 		return []byte(strconv.Itoa(val))
 	default:
-		log.Printf("interface: %#v", v)
-		log.Fatal("Unsupported type, please file an issue")
+		fatalf("Unsupported type %T, please file an issue", v)
 	}
 
 	return []byte{}
 }
 
-// update pushes a tree into a new provided key within Consul. The update is
-// performed recursively through the tree.
-func (t tree) update(base string) {
-	for k, v := range t {
-		key := base + "/" + k
-		subMap, ok := v.(map[string]interface{})
-		if ok {
-			// update the sub tree
-			tree(subMap).update(key)
-			continue
-		}
-
-		// update the leaf
-		push(key[1:], v)
+// push writes a single value to Consul. The flags of an entry are written
+// along with its value; indexes and sessions are assigned by Consul. The
+// function exits, reporting the run, if the value cannot be written.
+func push(key string, v interface{}) {
+	var flags uint64
+	if e, ok := v.(entry); ok {
+		v, flags = e.Value, e.Flags
 	}
-}
 
-func push(key string, v interface{}) {
 	val := resolveBytes(v)
-	_, err := kv.Put(&consul.KVPair{
+	_, err := destKV.Put(&consul.KVPair{
 		Key:   key,
 		Value: val,
+		Flags: flags,
 	}, nil)
 	if err != nil {
-		log.Fatalf("Failed to write to Consul => {%s}", err)
+		summary.Failed.addListed(key)
+		summary.report()
+		consulFailed("write", key, err, "Failed to write to Consul, %s => {%s}", key, err)
 	}
+	summary.Bytes += len(val)
 }
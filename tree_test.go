@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestAddFolderValue(t *testing.T) {
+	expected := map[string]interface{}{"a": "1", "a/b": "2", "a/b/c": "3"}
+	orders := [][]string{{"a", "a/b", "a/b/c"}, {"a/b/c", "a/b", "a"}}
+	for _, order := range orders {
+		values := tree{}
+		for _, key := range order {
+			values.add(key, expected[key])
+		}
+
+		if leaves := values.flatten(); !reflect.DeepEqual(leaves, expected) {
+			t.Errorf("Expected %v when adding %v, recieved: %v", expected, order, leaves)
+		}
+		folder := values["a"].(map[string]interface{})
+		if folder[folderValue] != "1" {
+			t.Errorf("Expected the folder's value in %s, recieved: %v", folderValue, folder)
+		}
+	}
+}
+
+func TestFolderKeys(t *testing.T) {
+	values := tree{}
+	values.add("app/feature/", "")
+	values.add("app/other/", "")
+	values.add("app/other/x", "1")
+
+	values.add("app/db/", "primary")
+	values.add("app/db", "secondary")
+
+	expected := map[string]interface{}{
+		"app/feature/": "",
+		"app/other/":   "",
+		"app/other/x":  "1",
+		"app/db/":      "primary",
+		"app/db":       "secondary",
+	}
+	if leaves := values.flatten(); !reflect.DeepEqual(leaves, expected) {
+		t.Errorf("Expected %v, recieved: %v", expected, leaves)
+	}
+	if feature, ok := values["app"].(map[string]interface{})["feature"].(map[string]interface{}); !ok || len(feature) != 0 {
+		t.Errorf("Expected an empty folder, recieved: %v", values)
+	}
+
+	rebuilt := tree{}
+	for key, v := range values.flatten() {
+		rebuilt.add(key, v)
+	}
+	if !reflect.DeepEqual(rebuilt, values) {
+		t.Errorf("Expected %v to survive flattening, recieved: %v", values, rebuilt)
+	}
+}
+
+func TestBinaryValueRoundTrip(t *testing.T) {
+	blob := []byte{0x1f, 0x8b, 0x08, 0x00, 0xff, 0xfe}
+	values := tree{}
+	values.add("certs/server.der", bytesValue(blob))
+	values.add("certs/meta", entry{Value: bytesValue(blob), Flags: 3})
+	values.add("certs/name", bytesValue([]byte("server ✓")))
+
+	data, err := json.Marshal(values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !utf8.Valid(data) {
+		t.Errorf("Expected valid UTF-8 JSON, recieved: %q", data)
+	}
+
+	loaded := tree{}
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		t.Fatal(err)
+	}
+	loaded.decodeEntries()
+	leaves := loaded.flatten()
+
+	if !bytes.Equal(resolveBytes(leaves["certs/server.der"]), blob) {
+		t.Errorf("Expected %v, recieved: %#v", blob, leaves["certs/server.der"])
+	}
+	if e, ok := leaves["certs/meta"].(entry); !ok || e.Flags != 3 || !bytes.Equal(resolveBytes(e.Value), blob) {
+		t.Errorf("Expected the entry to keep its bytes, recieved: %#v", leaves["certs/meta"])
+	}
+	if leaves["certs/name"] != "server ✓" {
+		t.Errorf("Expected text values to stay strings, recieved: %#v", leaves["certs/name"])
+	}
+}
+
+func TestEntryFlagsKeepPrecision(t *testing.T) {
+	flags := uint64(1<<63 + 1)
+	data, err := json.Marshal(tree{"ttl": entry{Value: "30", Flags: flags, ModifyIndex: 12}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := tree{}
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		t.Fatal(err)
+	}
+	loaded.decodeEntries()
+	if e, ok := loaded["ttl"].(entry); !ok || e.Flags != flags || e.ModifyIndex != 12 {
+		t.Errorf("Expected flags %d, recieved: %#v", flags, loaded["ttl"])
+	}
+
+	if n := toUint("$flags", float64(42)); n != 42 {
+		t.Errorf("Expected numbers below 2^53 to be read, recieved: %d", n)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// placeholder matches a ${NAME} placeholder, or the $${ escape that stands
+// for a literal "${".
+var placeholder = regexp.MustCompile(`\$\$\{|\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// loadVariables gathers the values available to placeholders. Environment
+// variables are overridden by the variable files, in order, which are in
+// turn overridden by -var flags. The function exits if a file or flag is
+// malformed.
+func loadVariables(files, vars []string) map[string]string {
+	values := map[string]string{}
+	for _, env := range os.Environ() {
+		parts := strings.SplitN(env, "=", 2)
+		values[parts[0]] = parts[1]
+	}
+
+	for _, filename := range files {
+		for k, v := range readVarFile(filename) {
+			values[k] = v
+		}
+	}
+
+	for _, v := range vars {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			usageErrorf("Invalid variable, %s, expected name=value", v)
+		}
+		values[parts[0]] = parts[1]
+	}
+
+	return values
+}
+
+// readVarFile reads a JSON or YAML file holding a flat object of variables.
+func readVarFile(filename string) map[string]string {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		fatalf("Failed to read variable file, %s => {%s}", filename, err)
+	}
+
+	raw := map[string]interface{}{}
+	switch path.Ext(filename) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &raw)
+	default:
+		err = json.Unmarshal(data, &raw)
+	}
+	if err != nil {
+		fatalf("Failed to decode variable file, %s => {%s}", filename, err)
+	}
+
+	values := map[string]string{}
+	for k, v := range raw {
+		switch v.(type) {
+		case string, float64, int, bool:
+			values[k] = fmt.Sprint(v)
+		default:
+			fatalf("Variable must be a string, number or boolean, %s in %s", k, filename)
+		}
+	}
+	return values
+}
+
+// substituteString replaces the placeholders in a string. Placeholders that
+// have no value are left in place and added to missing.
+func substituteString(s string, vars map[string]string, missing map[string]bool) string {
+	return placeholder.ReplaceAllStringFunc(s, func(match string) string {
+		if match == "$${" {
+			return "${"
+		}
+
+		name := match[2 : len(match)-1]
+		value, ok := vars[name]
+		if !ok {
+			missing[name] = true
+			return match
+		}
+		return value
+	})
+}
+
+// substitute returns a copy of the tree with the placeholders in its keys and
+// string values replaced. The names of variables without a value are added to
+// missing.
+func (t tree) substitute(vars map[string]string, missing map[string]bool) tree {
+	result := tree{}
+	for k, v := range t {
+		key := substituteString(k, vars, missing)
+
+		switch val := v.(type) {
+		case map[string]interface{}:
+			result[key] = map[string]interface{}(tree(val).substitute(vars, missing))
+		case string:
+			result[key] = substituteString(val, vars, missing)
+		case entry:
+			if s, ok := val.Value.(string); ok {
+				val.Value = substituteString(s, vars, missing)
+			}
+			result[key] = val
+		default:
+			result[key] = v
+		}
+	}
+	return result
+}
+
+// substituteVariables resolves every placeholder in the tree. The function
+// exits listing every variable that has no value.
+func substituteVariables(t tree, files, vars []string) tree {
+	missing := map[string]bool{}
+	result := t.substitute(loadVariables(files, vars), missing)
+
+	if len(missing) > 0 {
+		names := []string{}
+		for name := range missing {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fatal(classValidation, logFields{}, "Failed to resolve %d variables: %s", len(names), strings.Join(names, ", "))
+	}
+
+	return result
+}
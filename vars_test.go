@@ -0,0 +1,38 @@
+package main
+
+import (
+	"sort"
+	"testing"
+)
+
+func TestSubstitute(t *testing.T) {
+	vars := map[string]string{"ENV": "prod", "HOST": "db.prod"}
+	values := tree{
+		"${ENV}-db": map[string]interface{}{
+			"host":     "${HOST}:${PORT}",
+			"template": "$${HOST}",
+			"size":     float64(3),
+		},
+		"${REGION}": "x",
+	}
+
+	missing := map[string]bool{}
+	result := values.substitute(vars, missing)
+
+	db, ok := result["prod-db"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("Expected key to be substituted, recieved: %v", result)
+	}
+	if db["host"] != "db.prod:${PORT}" || db["template"] != "${HOST}" || db["size"] != float64(3) {
+		t.Errorf("Unexpected values: %v", db)
+	}
+
+	names := []string{}
+	for name := range missing {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if len(names) != 2 || names[0] != "PORT" || names[1] != "REGION" {
+		t.Errorf("Expected PORT and REGION to be missing, recieved: %v", names)
+	}
+}